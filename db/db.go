@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"math/bits"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
@@ -37,56 +41,238 @@ func NewRO(path string) (*DB, error) {
 const (
 	// prefixes used in leveldb
 	found     = "found"
+	copies    = "copy"
 	missing   = "missing"
+	corrupt   = "corrupt"
 	parent    = "parent"
 	last      = "last"
 	camliType = "type"
 	mimeType  = "mime"
+	claim     = "claim"
+	packFile  = "pack"
+	verified  = "verified"
+	signers   = "signer"
+	// resume marker for verification, kept apart from last
+	verifyLast = "verifylast"
 
 	// bounds for iterators
 	start = "\x00"
 	limit = "\xff"
+
+	// sortable timestamps for claim keys
+	claimDate = "2006-01-02T15:04:05.000000000Z"
+
+	// number of writes accumulated by bulk operations before
+	// flushing
+	batchSize = 10000
 )
 
-func (d *DB) PlaceMIME(ref, mime string) error {
-	return d.db.Put(pack(mimeType, mime, ref), nil, nil)
+// PlaceMIME notes the MIME type and content size of a file.
+func (d *DB) PlaceMIME(ref, mime string, size int64) error {
+	return d.db.Put(pack(mimeType, mime, ref), pack(strconv.FormatInt(size, 10)), nil)
 }
 
-// Place notes the presence of a blob at a particular location.
-func (d *DB) Place(ref, location, ct string, dependencies []string) (err error) {
-	b := new(leveldb.Batch)
-	// TODO(dichro): duplicates are interesting, but pretty rare,
-	// so probably not worth tracking?
-	b.Put(pack(found, ref), pack(location))
-	b.Put(pack(last), pack(location))
-	if ct != "" {
-		b.Put(pack(camliType, ct, ref), nil)
+// PlaceRecovered notes the presence of a blob that has been added to
+// the blobstore at an unknown location, such as one copied in from a
+// backup. The resume marker is left untouched.
+func (d *DB) PlaceRecovered(ref, ct string, size uint32, dependencies []string) error {
+	p := d.newPlacer(true)
+	if err := p.Place(ref, "", ct, size, dependencies); err != nil {
+		return err
 	}
-	for _, dep := range dependencies {
-		b.Put(pack(parent, dep, ref), nil)
-		// TODO(dichro): should these always be looked up
-		// inline? Maybe a post-scan would be faster for bulk
-		// insert?
-		if ok, _ := d.db.Has(pack(found, dep), nil); !ok {
-			b.Put(pack(missing, dep, ref), nil)
-		}
+	return p.Flush()
+}
+
+// PlaceSigner notes that a permanode or claim was signed with the
+// public key in the blob signer. These aren't parent edges, so a
+// missing key isn't reported against everything it signed.
+func (d *DB) PlaceSigner(signer, signed string) error {
+	return d.db.Put(pack(signers, signer, signed), nil, nil)
+}
+
+// Signs reports whether ref is known to have signed anything.
+func (d *DB) Signs(ref string) (bool, error) {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(signers, ref, start),
+		Limit: pack(signers, ref, limit),
+	}, nil)
+	defer it.Release()
+	return it.Next(), it.Error()
+}
+
+// HasType reports whether any blob of a camliType has been found.
+func (d *DB) HasType(ct string) (bool, error) {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(camliType, ct, start),
+		Limit: pack(camliType, ct, limit),
+	}, nil)
+	defer it.Release()
+	return it.Next(), it.Error()
+}
+
+// Claim is a mutation of a permanode.
+type Claim struct {
+	Ref, Permanode         string
+	Date                   time.Time
+	Type, Attribute, Value string
+}
+
+// PlaceClaim notes a claim against a permanode. A claim against
+// camliContent additionally records the permanode as a parent of its
+// current content, and drops it as a parent of any content that has
+// been replaced. PlaceClaim should be called before the claim blob
+// itself is placed, so that an interrupted scan will revisit the
+// claim.
+func (d *DB) PlaceClaim(c Claim) error {
+	p := d.newPlacer(true)
+	if err := p.PlaceClaim(c); err != nil {
+		return err
 	}
+	return p.Flush()
+}
+
+// Claims returns all known claims against a permanode, oldest first.
+func (d *DB) Claims(permanode string) (claims []Claim, err error) {
 	it := d.db.NewIterator(&util.Range{
-		Start: pack(missing, ref, start),
-		Limit: pack(missing, ref, limit),
+		Start: pack(claim, permanode, start),
+		Limit: pack(claim, permanode, limit),
 	}, nil)
 	defer it.Release()
 	for it.Next() {
-		b.Delete(it.Key())
+		parts := unpack(it.Key())
+		date, err := time.Parse(claimDate, parts[2])
+		if err != nil {
+			return nil, err
+		}
+		// values may contain anything, including separators
+		value := strings.SplitN(string(it.Value()), "|", 3)
+		if len(value) != 3 {
+			return nil, fmt.Errorf("%s: bad claim entry %q", parts[3], it.Value())
+		}
+		claims = append(claims, Claim{
+			Ref:       parts[3],
+			Permanode: permanode,
+			Date:      date,
+			Type:      value[0],
+			Attribute: value[1],
+			Value:     value[2],
+		})
 	}
-	if err := it.Error(); err != nil {
-		fmt.Println(err)
+	err = it.Error()
+	return
+}
+
+// Attribute returns the current value of a permanode's attribute, as
+// determined by replaying all known claims against it. Multi-valued
+// attributes return their most recently added value.
+func (d *DB) Attribute(permanode, attr string) (value string, err error) {
+	claims, err := d.Claims(permanode)
+	if err != nil {
+		return
+	}
+	return attributeValue(claims, attr), nil
+}
+
+// attributeValue replays claims, oldest first, to find the current
+// value of an attribute.
+func attributeValue(claims []Claim, attr string) (value string) {
+	for _, c := range claims {
+		if c.Attribute != attr {
+			continue
+		}
+		switch c.Type {
+		case "set-attribute", "add-attribute":
+			value = c.Value
+		case "del-attribute":
+			if c.Value == "" || c.Value == value {
+				value = ""
+			}
+		}
+	}
+	return
+}
+
+type byDate []Claim
+
+func (b byDate) Len() int           { return len(b) }
+func (b byDate) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byDate) Less(i, j int) bool { return b[i].Date.Before(b[j].Date) }
+
+// ResolveMissing recomputes all missing entries from the parent and
+// found entries in a single sorted pass, leaving the index as if
+// every blob's missing dependencies had been looked up as it was
+// placed. It returns the number of missing entries added and
+// removed.
+func (d *DB) ResolveMissing() (added, removed int, err error) {
+	snap, err := d.db.GetSnapshot()
+	if err != nil {
+		return
+	}
+	defer snap.Release()
+	newIterator := func(prefix string) iterator.Iterator {
+		return snap.NewIterator(&util.Range{
+			Start: pack(prefix, start),
+			Limit: pack(prefix, limit),
+		}, nil)
+	}
+	parents, founds, missings := newIterator(parent), newIterator(found), newIterator(missing)
+	defer parents.Release()
+	defer founds.Release()
+	defer missings.Release()
+
+	b := new(leveldb.Batch)
+	flush := func(min int) error {
+		if b.Len() < min {
+			return nil
+		}
+		err := d.db.Write(b, nil)
+		b.Reset()
+		return err
+	}
+	moreFound, moreMissing := founds.Next(), missings.Next()
+	for parents.Next() {
+		parts := unpack(parents.Key())
+		child := parts[1]
+		for moreFound && unpack(founds.Key())[1] < child {
+			moreFound = founds.Next()
+		}
+		if moreFound && unpack(founds.Key())[1] == child {
+			continue
+		}
+		// both keyspaces are ordered by child, then parent
+		want := pack(missing, child, parts[2])
+		for moreMissing && bytes.Compare(missings.Key(), want) < 0 {
+			b.Delete(missings.Key())
+			removed++
+			moreMissing = missings.Next()
+		}
+		if moreMissing && bytes.Equal(missings.Key(), want) {
+			moreMissing = missings.Next()
+			continue
+		}
+		b.Put(want, nil)
+		added++
+		if err = flush(batchSize); err != nil {
+			return
+		}
 	}
-	err = d.db.Write(b, nil)
+	for ; moreMissing; moreMissing = missings.Next() {
+		b.Delete(missings.Key())
+		removed++
+		if err = flush(batchSize); err != nil {
+			return
+		}
+	}
+	for _, it := range []iterator.Iterator{parents, founds, missings} {
+		if err = it.Error(); err != nil {
+			return
+		}
+	}
+	err = flush(1)
 	return
 }
 
-// Last returns the last location successfully Placed.
+// Last returns the last location successfully placed.
 func (d *DB) Last() string {
 	if data, err := d.db.Get(pack(last), nil); err == nil {
 		return string(data)
@@ -96,6 +282,330 @@ func (d *DB) Last() string {
 	return ""
 }
 
+// PlaceCorrupt notes the presence of a blob whose contents don't
+// match its ref at a particular location.
+func (d *DB) PlaceCorrupt(ref, location string, size uint32) error {
+	p := d.newPlacer(true)
+	if err := p.PlaceCorrupt(ref, location, size); err != nil {
+		return err
+	}
+	return p.Flush()
+}
+
+// ClearCorrupt forgets all damaged copies of a blob, once they have
+// been removed from the blobstore.
+func (d *DB) ClearCorrupt(ref string) error {
+	b := new(leveldb.Batch)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(corrupt, ref, start),
+		Limit: pack(corrupt, ref, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		b.Delete(it.Key())
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return d.db.Write(b, nil)
+}
+
+// PlaceVerified records that the copies of a blob were re-hashed at
+// a particular time, noting those that are now corrupt, and advances
+// the verification resume marker to the blob. Unlike PlaceCorrupt,
+// the scan resume marker is left untouched. Corrupt copies are no
+// longer counted as copies; a blob left without any is no longer
+// found, just as if it had been corrupt when scanned, so that it's
+// reported missing and can be repaired.
+func (d *DB) PlaceVerified(ref string, size uint32, at time.Time, corruptLocations []string) error {
+	b := new(leveldb.Batch)
+	b.Put(pack(verified, ref), pack(at.UTC().Format(claimDate)))
+	b.Put(pack(verifyLast), pack(ref))
+	if len(corruptLocations) == 0 {
+		return d.db.Write(b, nil)
+	}
+	locations, err := d.Locations(ref)
+	if err != nil {
+		return err
+	}
+	bad := make(map[string]bool)
+	for _, location := range corruptLocations {
+		b.Put(pack(corrupt, ref, location), pack(formatSize(size)))
+		b.Delete(pack(copies, ref, location))
+		bad[location] = true
+	}
+	var good []string
+	for _, l := range locations {
+		if !bad[l] {
+			good = append(good, l)
+		}
+	}
+	data, err := d.db.Get(pack(found, ref), nil)
+	switch err {
+	case nil:
+	case leveldb.ErrNotFound:
+		return d.db.Write(b, nil)
+	default:
+		return err
+	}
+	location, foundSize, ct := unpackFound(data)
+	switch {
+	case len(good) == 0:
+		b.Delete(pack(found, ref))
+		if ct != "" {
+			b.Delete(pack(camliType, ct, ref))
+		}
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(parent, ref, start),
+			Limit: pack(parent, ref, limit),
+		}, nil)
+		for it.Next() {
+			b.Put(pack(missing, ref, unpack(it.Key())[2]), nil)
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return err
+		}
+	case !bad[location]:
+	case untyped(data):
+		b.Put(pack(found, ref), pack(good[len(good)-1]))
+	default:
+		b.Put(pack(found, ref), pack(good[len(good)-1], formatSize(foundSize), ct))
+	}
+	return d.db.Write(b, nil)
+}
+
+// VerifyLast returns the last blob whose copies were verified, for
+// resuming verification.
+func (d *DB) VerifyLast() string {
+	data, err := d.db.Get(pack(verifyLast), nil)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// ResetVerify clears the verification resume marker, so that the
+// next verification starts from the first blob.
+func (d *DB) ResetVerify() error {
+	return d.db.Delete(pack(verifyLast), nil)
+}
+
+// Corruption is a damaged copy of a blob.
+type Corruption struct {
+	Ref, Location string
+	Size          uint32
+}
+
+// Corrupt streams all known damaged copies of blobs.
+func (d *DB) Corrupt() <-chan Corruption {
+	ch := make(chan Corruption)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(corrupt, start),
+			Limit: pack(corrupt, limit),
+		}, nil)
+		defer it.Release()
+		for it.Next() {
+			parts := unpack(it.Key())
+			ch <- Corruption{
+				Ref:      parts[1],
+				Location: parts[2],
+				Size:     parseSize(it.Value()),
+			}
+		}
+	}()
+	return ch
+}
+
+// Locations returns every known location of a blob.
+func (d *DB) Locations(ref string) (locations []string, err error) {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(copies, ref, start),
+		Limit: pack(copies, ref, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		parts := unpack(it.Key())
+		locations = append(locations, parts[2])
+	}
+	if err = it.Error(); err != nil || len(locations) > 0 {
+		return
+	}
+	// indexes built before copies were tracked only know of one.
+	switch data, err := d.db.Get(pack(found, ref), nil); err {
+	case nil:
+		if location, _, _ := unpackFound(data); location != "" {
+			return []string{location}, nil
+		}
+		return nil, nil
+	case leveldb.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// Dup describes a blob that is stored at more than one location.
+type Dup struct {
+	Ref       string
+	Size      uint32
+	Locations []string
+}
+
+// Wasted returns the number of bytes consumed by redundant copies.
+func (d Dup) Wasted() uint64 {
+	return uint64(d.Size) * uint64(len(d.Locations)-1)
+}
+
+// Dups streams all blobs that have been placed at more than one
+// location.
+func (d *DB) Dups() <-chan Dup {
+	ch := make(chan Dup)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(copies, start),
+			Limit: pack(copies, limit),
+		}, nil)
+		defer it.Release()
+		var dup Dup
+		for it.Next() {
+			parts := unpack(it.Key())
+			if parts[1] != dup.Ref {
+				if len(dup.Locations) > 1 {
+					ch <- dup
+				}
+				dup = Dup{Ref: parts[1]}
+			}
+			dup.Size = parseSize(it.Value())
+			dup.Locations = append(dup.Locations, parts[2])
+		}
+		if len(dup.Locations) > 1 {
+			ch <- dup
+		}
+	}()
+	return ch
+}
+
+// Blob describes a blob known to the index.
+type Blob struct {
+	Ref, CamliType string
+	Size           uint32
+	// Location is where the blob was most recently found, if
+	// anywhere.
+	Location string
+}
+
+// IsRoot reports whether a blob is a root of the blob graph, that is,
+// a permanode or a claim.
+func (b Blob) IsRoot() bool {
+	return b.CamliType == "permanode" || b.CamliType == "claim"
+}
+
+// Lookup returns what the index knows about a blob, and whether it
+// has been found at all.
+func (d *DB) Lookup(ref string) (b Blob, ok bool, err error) {
+	b.Ref = ref
+	data, err := d.db.Get(pack(found, ref), nil)
+	switch err {
+	case nil:
+		b.Location, b.Size, b.CamliType = unpackFound(data)
+		return b, true, nil
+	case leveldb.ErrNotFound:
+		return b, false, nil
+	default:
+		return b, false, err
+	}
+}
+
+// Blobs streams all found blobs.
+func (d *DB) Blobs() <-chan Blob {
+	return d.BlobsAfter("")
+}
+
+// BlobsAfter streams the found blobs that sort after ref.
+func (d *DB) BlobsAfter(ref string) <-chan Blob {
+	rng := &util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}
+	if ref != "" {
+		rng.Start = append(pack(found, ref), 0)
+	}
+	ch := make(chan Blob)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(rng, nil)
+		defer it.Release()
+		for it.Next() {
+			b := Blob{Ref: unpack(it.Key())[1]}
+			b.Location, b.Size, b.CamliType = unpackFound(it.Value())
+			ch <- b
+		}
+	}()
+	return ch
+}
+
+// Untyped counts the blobs whose size and type weren't recorded,
+// because they were indexed before either was. Rescanning with
+// --restart records them.
+func (d *DB) Untyped() (n int, err error) {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		if untyped(it.Value()) {
+			n++
+		}
+	}
+	return n, it.Error()
+}
+
+// Orphans streams all blobs that have no known parents and are not
+// themselves roots. Blobs whose type wasn't recorded, in indexes
+// built before types were, are skipped, since they may be roots; see
+// Untyped.
+func (d *DB) Orphans() <-chan Blob {
+	ch := make(chan Blob)
+	go func() {
+		defer close(ch)
+		founds := d.db.NewIterator(&util.Range{
+			Start: pack(found, start),
+			Limit: pack(found, limit),
+		}, nil)
+		defer founds.Release()
+		parents := d.db.NewIterator(&util.Range{
+			Start: pack(parent, start),
+			Limit: pack(parent, limit),
+		}, nil)
+		defer parents.Release()
+		moreParents := parents.Next()
+		for founds.Next() {
+			ref := unpack(founds.Key())[1]
+			for moreParents && unpack(parents.Key())[1] < ref {
+				moreParents = parents.Next()
+			}
+			if moreParents && unpack(parents.Key())[1] == ref {
+				continue
+			}
+			if untyped(founds.Value()) {
+				continue
+			}
+			b := Blob{Ref: ref}
+			b.Location, b.Size, b.CamliType = unpackFound(founds.Value())
+			if b.IsRoot() {
+				continue
+			}
+			ch <- b
+		}
+	}()
+	return ch
+}
+
 // Missing streams the currently unknown blobs.
 func (d *DB) Missing() <-chan string {
 	ch := make(chan string)
@@ -142,35 +652,63 @@ func (d *DB) streamBlobs(ch chan<- string, refPos int, rng *util.Range) {
 }
 
 type Stats struct {
-	Blobs, Links, Missing, Unknown uint64
-	CamliTypes, MIMETypes          map[string]int64
+	Blobs, Copies, Links, Missing, Corrupt, Claims, Packs, Verified, Unknown uint64
+	CamliTypes, MIMETypes                                                    map[string]int64
+	// Bytes counts each blob once, however many copies it has.
+	Bytes                         uint64
+	CamliTypeBytes, MIMETypeBytes map[string]int64
+	// Sizes is a histogram of blob sizes: Sizes[i] counts blobs
+	// of at least 2^(i-1) and less than 2^i bytes.
+	Sizes [33]uint64
 }
 
 func (s Stats) String() string {
-	return fmt.Sprintf("%d blobs, %d links, %d missing; %d unknown index entries",
-		s.Blobs, s.Links, s.Missing, s.Unknown)
+	return fmt.Sprintf("%d blobs (%d bytes), %d copies, %d links, %d missing, %d corrupt, %d claims, %d packs, %d verified; %d unknown index entries",
+		s.Blobs, s.Bytes, s.Copies, s.Links, s.Missing, s.Corrupt, s.Claims, s.Packs, s.Verified, s.Unknown)
 }
 
 // Stats scans the entire index counting various things.
 func (d *DB) Stats() (s Stats) {
 	s.CamliTypes = make(map[string]int64)
 	s.MIMETypes = make(map[string]int64)
+	s.CamliTypeBytes = make(map[string]int64)
+	s.MIMETypeBytes = make(map[string]int64)
 	it := d.db.NewIterator(nil, nil)
 	defer it.Release()
+	lastCopy := ""
 	for it.Next() {
 		parts := unpack(it.Key())
 		switch parts[0] {
-		case last:
+		case last, verifyLast, signers:
 		case found:
 			s.Blobs++
+		case copies:
+			s.Copies++
+			if parts[1] != lastCopy {
+				lastCopy = parts[1]
+				size := parseSize(it.Value())
+				s.Bytes += uint64(size)
+				s.Sizes[bits.Len32(size)]++
+			}
 		case parent:
 			s.Links++
 		case missing:
 			s.Missing++
+		case corrupt:
+			s.Corrupt++
+		case claim:
+			s.Claims++
+		case packFile:
+			s.Packs++
+		case verified:
+			s.Verified++
 		case camliType:
 			s.CamliTypes[parts[1]]++
+			s.CamliTypeBytes[parts[1]] += int64(parseSize(it.Value()))
 		case mimeType:
 			s.MIMETypes[parts[1]]++
+			size, _ := strconv.ParseInt(string(it.Value()), 10, 64)
+			s.MIMETypeBytes[parts[1]] += size
 		default:
 			s.Unknown++
 		}
@@ -180,9 +718,19 @@ func (d *DB) Stats() (s Stats) {
 
 // Parents returns all immediate parents of a blob ref.
 func (d *DB) Parents(ref string) (parents []string, err error) {
+	return d.referrers(parent, ref)
+}
+
+// MissingFrom returns the parents that reference a blob ref while it
+// is missing, or nothing if it isn't.
+func (d *DB) MissingFrom(ref string) (parents []string, err error) {
+	return d.referrers(missing, ref)
+}
+
+func (d *DB) referrers(prefix, ref string) (parents []string, err error) {
 	it := d.db.NewIterator(&util.Range{
-		Start: pack(parent, ref, start),
-		Limit: pack(parent, ref, limit),
+		Start: pack(prefix, ref, start),
+		Limit: pack(prefix, ref, limit),
 	}, nil)
 	defer it.Release()
 	for it.Next() {
@@ -234,3 +782,33 @@ func pack(prefix string, fields ...string) []byte {
 func unpack(bts []byte) []string {
 	return strings.Split(string(bts), "|")
 }
+
+// unpackFound decodes the value of a found entry. Indexes built
+// before sizes and types were recorded only hold the location.
+func unpackFound(bts []byte) (location string, size uint32, ct string) {
+	parts := unpack(bts)
+	location = parts[0]
+	if len(parts) == 3 {
+		size = parseSize([]byte(parts[1]))
+		ct = parts[2]
+	}
+	return
+}
+
+// untyped reports whether a found entry predates the recording of
+// sizes and types.
+func untyped(bts []byte) bool {
+	return len(unpack(bts)) != 3
+}
+
+func formatSize(size uint32) string {
+	return strconv.FormatUint(uint64(size), 10)
+}
+
+func parseSize(bts []byte) uint32 {
+	size, err := strconv.ParseUint(string(bts), 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(size)
+}
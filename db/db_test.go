@@ -0,0 +1,229 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// newTestDB returns an empty index held in memory.
+func newTestDB(t *testing.T) *DB {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DB{db: db}
+}
+
+// keys returns every key under prefix.
+func keys(t *testing.T, d *DB, prefix string) []string {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(prefix, start),
+		Limit: pack(prefix, limit),
+	}, nil)
+	defer it.Release()
+	var ks []string
+	for it.Next() {
+		ks = append(ks, string(it.Key()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+// placed is a blob to place in a test index.
+type placed struct {
+	ref, location, ct string
+	size              uint32
+	deps              []string
+}
+
+// placeAll places blobs in a single batch, looking up missing
+// dependencies as they're placed unless deferMissing is set.
+func placeAll(t *testing.T, d *DB, deferMissing bool, blobs ...placed) {
+	p := d.newPlacer(!deferMissing)
+	p.maxBlobs, p.maxBytes = len(blobs)+1, 1<<30
+	for _, b := range blobs {
+		if err := p.Place(b.ref, b.location, b.ct, b.size, b.deps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveMissing(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		blobs          []placed
+		stale          []string
+		want           []string
+		added, removed int
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "all found",
+			blobs: []placed{
+				{ref: "a", location: "0 0", deps: []string{"b"}},
+				{ref: "b", location: "0 10"},
+			},
+		},
+		{
+			name: "missing from several parents",
+			blobs: []placed{
+				{ref: "a", location: "0 0", deps: []string{"c", "d"}},
+				{ref: "b", location: "0 10", deps: []string{"c"}},
+				{ref: "d", location: "0 20"},
+			},
+			want:  []string{"missing|c|a", "missing|c|b"},
+			added: 2,
+		},
+		{
+			name: "stale entries removed",
+			blobs: []placed{
+				{ref: "a", location: "0 0", deps: []string{"b", "c"}},
+				{ref: "b", location: "0 10"},
+			},
+			stale:   []string{"missing|b|a", "missing|c|a", "missing|z|y"},
+			want:    []string{"missing|c|a"},
+			removed: 2,
+		},
+		{
+			name: "stale entries between wanted ones",
+			blobs: []placed{
+				{ref: "a", location: "0 0", deps: []string{"b", "d"}},
+			},
+			stale:   []string{"missing|c|a"},
+			want:    []string{"missing|b|a", "missing|d|a"},
+			added:   2,
+			removed: 1,
+		},
+	} {
+		d := newTestDB(t)
+		placeAll(t, d, true, test.blobs...)
+		for _, k := range test.stale {
+			if err := d.db.Put([]byte(k), nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		added, removed, err := d.ResolveMissing()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := keys(t, d, missing); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: missing %q, want %q", test.name, got, test.want)
+		}
+		if added != test.added || removed != test.removed {
+			t.Errorf("%s: added %d, removed %d, want %d, %d", test.name, added, removed, test.added, test.removed)
+		}
+		d.Close()
+	}
+}
+
+func TestResolveMissingMatchesInline(t *testing.T) {
+	blobs := []placed{
+		{ref: "f", location: "0 0", ct: "file", deps: []string{"x", "b"}},
+		{ref: "b", location: "0 10", ct: "bytes", deps: []string{"y", "x"}},
+		{ref: "s", location: "0 20", ct: "static-set", deps: []string{"f", "g"}},
+	}
+	inline, deferred := newTestDB(t), newTestDB(t)
+	defer inline.Close()
+	defer deferred.Close()
+	placeAll(t, inline, false, blobs...)
+	placeAll(t, deferred, true, blobs...)
+	if _, _, err := deferred.ResolveMissing(); err != nil {
+		t.Fatal(err)
+	}
+	want, got := keys(t, inline, missing), keys(t, deferred, missing)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deferred %q, inline %q", got, want)
+	}
+}
+
+func TestPlaceVerified(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		corrupt []string
+		// keys left under each prefix
+		want map[string][]string
+		// found location of a, if it's still found
+		found string
+	}{
+		{
+			name: "intact",
+			want: map[string][]string{
+				copies:  {"copy|a|0 0", "copy|a|1 0", "copy|f|2 0"},
+				corrupt: nil,
+				missing: nil,
+			},
+			found: "1 0",
+		},
+		{
+			name:    "found copy corrupt",
+			corrupt: []string{"1 0"},
+			want: map[string][]string{
+				copies:    {"copy|a|0 0", "copy|f|2 0"},
+				corrupt:   {"corrupt|a|1 0"},
+				camliType: {"type|bytes|a", "type|file|f"},
+				missing:   nil,
+			},
+			found: "0 0",
+		},
+		{
+			name:    "other copy corrupt",
+			corrupt: []string{"0 0"},
+			want: map[string][]string{
+				copies:  {"copy|a|1 0", "copy|f|2 0"},
+				corrupt: {"corrupt|a|0 0"},
+			},
+			found: "1 0",
+		},
+		{
+			name:    "every copy corrupt",
+			corrupt: []string{"0 0", "1 0"},
+			want: map[string][]string{
+				copies:    {"copy|f|2 0"},
+				corrupt:   {"corrupt|a|0 0", "corrupt|a|1 0"},
+				camliType: {"type|file|f"},
+				missing:   {"missing|a|f"},
+			},
+		},
+	} {
+		d := newTestDB(t)
+		placeAll(t, d, false,
+			placed{ref: "a", location: "0 0", ct: "bytes", size: 5},
+			placed{ref: "a", location: "1 0", ct: "bytes", size: 5},
+			placed{ref: "f", location: "2 0", ct: "file", size: 5, deps: []string{"a"}},
+		)
+		if err := d.PlaceVerified("a", 5, time.Unix(1400000000, 0), test.corrupt); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		for prefix, want := range test.want {
+			if got := keys(t, d, prefix); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s %q, want %q", test.name, prefix, got, want)
+			}
+		}
+		b, ok, err := d.Lookup("a")
+		if err != nil || ok != (test.found != "") || b.Location != test.found {
+			t.Errorf("%s: found at %q (%v, %v), want %q", test.name, b.Location, ok, err, test.found)
+		}
+		if ok && (b.Size != 5 || b.CamliType != "bytes") {
+			t.Errorf("%s: found %+v", test.name, b)
+		}
+		if got := keys(t, d, verified); !reflect.DeepEqual(got, []string{"verified|a"}) {
+			t.Errorf("%s: verified %q", test.name, got)
+		}
+		if got := d.VerifyLast(); got != "a" {
+			t.Errorf("%s: verification resume marker %q", test.name, got)
+		}
+		d.Close()
+	}
+}
@@ -0,0 +1,90 @@
+package db
+
+import "github.com/syndtr/goleveldb/leveldb/util"
+
+// Liveness determines whether blobs are reachable from a root: a
+// permanode, a claim, or one of a set of additional roots.
+type Liveness struct {
+	d     *DB
+	roots map[string]bool
+	// permanodes with a claim whose value is each ref, whether or
+	// not the claim is current
+	claimed map[string][]string
+	// results for blobs that are parents or claimants of others
+	memo map[string]bool
+}
+
+// NewLiveness returns a Liveness for the index, treating roots as
+// reachable in addition to permanodes and claims. Claims are
+// replayed once up front, so that every ref named by a claim against
+// a reachable permanode, such as members of a set or older
+// camliContent, is reachable too.
+func (d *DB) NewLiveness(roots map[string]bool) (*Liveness, error) {
+	l := &Liveness{
+		d:       d,
+		roots:   roots,
+		claimed: make(map[string][]string),
+		memo:    make(map[string]bool),
+	}
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(claim, start),
+		Limit: pack(claim, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		// values that aren't refs never match a blob
+		if v := unpack(it.Value()); len(v) == 3 && v[2] != "" {
+			permanode := unpack(it.Key())[1]
+			l.claimed[v[2]] = append(l.claimed[v[2]], permanode)
+		}
+	}
+	return l, it.Error()
+}
+
+// Live reports whether a blob is reachable from a root.
+func (l *Liveness) Live(b Blob) (bool, error) {
+	if b.IsRoot() || l.roots[b.Ref] {
+		return true, nil
+	}
+	// public keys are live if they've signed anything, since only
+	// roots are signed
+	switch signs, err := l.d.Signs(b.Ref); {
+	case err != nil:
+		return false, err
+	case signs:
+		return true, nil
+	}
+	for _, p := range l.claimed[b.Ref] {
+		if live, err := l.refLive(p); err != nil || live {
+			return live, err
+		}
+	}
+	parents, err := l.d.Parents(b.Ref)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range parents {
+		if live, err := l.refLive(p); err != nil || live {
+			return live, err
+		}
+	}
+	return false, nil
+}
+
+func (l *Liveness) refLive(ref string) (bool, error) {
+	if live, ok := l.memo[ref]; ok {
+		return live, nil
+	}
+	// blobs that were never found may still be claimed by a live
+	// permanode
+	b, _, err := l.d.Lookup(ref)
+	if err != nil {
+		return false, err
+	}
+	live, err := l.Live(b)
+	if err != nil {
+		return false, err
+	}
+	l.memo[ref] = live
+	return live, nil
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	d := newTestDB(t)
+	defer d.Close()
+	t0 := time.Unix(1400000000, 0)
+	for _, c := range []Claim{
+		{Ref: "c1", Permanode: "p", Date: t0, Type: "add-attribute", Attribute: "camliMember", Value: "member"},
+		{Ref: "c2", Permanode: "p", Date: t0, Type: "set-attribute", Attribute: "camliContent", Value: "old"},
+		{Ref: "c3", Permanode: "p", Date: t0.Add(time.Hour), Type: "set-attribute", Attribute: "camliContent", Value: "new"},
+		{Ref: "c4", Permanode: "p", Date: t0, Type: "set-attribute", Attribute: "title", Value: "holiday"},
+		// against a permanode that was never found
+		{Ref: "c5", Permanode: "gone", Date: t0, Type: "set-attribute", Attribute: "camliContent", Value: "orphaned"},
+	} {
+		if err := d.PlaceClaim(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.PlaceSigner("key", "p"); err != nil {
+		t.Fatal(err)
+	}
+	placeAll(t, d, false,
+		placed{ref: "p", location: "0 0", ct: "permanode"},
+		placed{ref: "c1", location: "0 1", ct: "claim"},
+		placed{ref: "c2", location: "0 2", ct: "claim"},
+		placed{ref: "c3", location: "0 3", ct: "claim"},
+		placed{ref: "c4", location: "0 4", ct: "claim"},
+		placed{ref: "c5", location: "0 5", ct: "claim"},
+		placed{ref: "key", location: "0 6"},
+		placed{ref: "member", location: "0 7", ct: "file"},
+		placed{ref: "old", location: "0 8", ct: "file", deps: []string{"old-chunk"}},
+		placed{ref: "old-chunk", location: "0 9"},
+		placed{ref: "new", location: "0 10", ct: "file", deps: []string{"new-chunk"}},
+		placed{ref: "new-chunk", location: "0 11"},
+		placed{ref: "orphaned", location: "0 12", ct: "file"},
+		placed{ref: "stray", location: "0 13"},
+		placed{ref: "set", location: "0 14", ct: "static-set", deps: []string{"listed"}},
+		placed{ref: "listed", location: "0 15"},
+	)
+	for _, test := range []struct {
+		roots map[string]bool
+		want  []string
+	}{
+		{
+			want: []string{"listed", "orphaned", "set", "stray"},
+		},
+		{
+			roots: map[string]bool{"set": true},
+			want:  []string{"orphaned", "stray"},
+		},
+	} {
+		l, err := d.NewLiveness(test.roots)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var unreachable []string
+		for b := range d.Blobs() {
+			live, err := l.Live(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !live {
+				unreachable = append(unreachable, b.Ref)
+			}
+		}
+		sort.Strings(unreachable)
+		if !reflect.DeepEqual(unreachable, test.want) {
+			t.Errorf("roots %v: unreachable %q, want %q", test.roots, unreachable, test.want)
+		}
+	}
+}
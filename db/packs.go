@@ -0,0 +1,305 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// PackState is what was known of a pack file when it was last
+// scanned in full.
+type PackState struct {
+	Size     int64
+	ModTime  time.Time
+	Checksum string
+}
+
+// Equal reports whether two states describe the same pack contents.
+// Checksums are only compared if both states have one.
+func (s PackState) Equal(o PackState) bool {
+	if s.Size != o.Size || !s.ModTime.Equal(o.ModTime) {
+		return false
+	}
+	return s.Checksum == "" || o.Checksum == "" || s.Checksum == o.Checksum
+}
+
+func packKey(n int) []byte {
+	return pack(packFile, fmt.Sprintf("%05d", n))
+}
+
+func (s PackState) value() []byte {
+	return pack(strconv.FormatInt(s.Size, 10), strconv.FormatInt(s.ModTime.UnixNano(), 10), s.Checksum)
+}
+
+// PlacePack records the state of a pack file once it has been
+// scanned.
+func (d *DB) PlacePack(n int, s PackState) error {
+	return d.db.Put(packKey(n), s.value(), nil)
+}
+
+// PlacePack is like DB.PlacePack, but is written with the pending
+// batch, and so along with the pack's blobs.
+func (p *Placer) PlacePack(n int, s PackState) {
+	p.b.Put(packKey(n), s.value())
+}
+
+// ForgetPack removes the recorded state of a pack file.
+func (d *DB) ForgetPack(n int) error {
+	return d.db.Delete(packKey(n), nil)
+}
+
+// Packs returns the recorded states of all pack files.
+func (d *DB) Packs() (map[int]PackState, error) {
+	packs := make(map[int]PackState)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(packFile, start),
+		Limit: pack(packFile, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		n, err := strconv.Atoi(unpack(it.Key())[1])
+		if err != nil {
+			continue
+		}
+		parts := unpack(it.Value())
+		if len(parts) != 3 {
+			continue
+		}
+		var s PackState
+		s.Size, _ = strconv.ParseInt(parts[0], 10, 64)
+		mtime, _ := strconv.ParseInt(parts[1], 10, 64)
+		s.ModTime = time.Unix(0, mtime)
+		s.Checksum = parts[2]
+		packs[n] = s
+	}
+	return packs, it.Error()
+}
+
+// DropLocations removes the copy and corrupt entries of every blob
+// whose copy at a location is stale, such as those in a pack file
+// that has been rewritten and is about to be rescanned. The found
+// entries are left alone until Reconcile. It returns the number of
+// entries dropped.
+func (d *DB) DropLocations(stale func(ref, location string) bool) (dropped int, err error) {
+	b := new(leveldb.Batch)
+	for _, prefix := range []string{copies, corrupt} {
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(prefix, start),
+			Limit: pack(prefix, limit),
+		}, nil)
+		for it.Next() {
+			if parts := unpack(it.Key()); !stale(parts[1], parts[2]) {
+				continue
+			}
+			b.Delete(it.Key())
+			dropped++
+			if b.Len() >= batchSize {
+				if err = d.db.Write(b, nil); err != nil {
+					break
+				}
+				b.Reset()
+			}
+		}
+		it.Release()
+		if err == nil {
+			err = it.Error()
+		}
+		if err != nil {
+			return
+		}
+	}
+	err = d.db.Write(b, nil)
+	return
+}
+
+// Reconcile brings the found entries in line with the copy entries
+// once stale copies have been dropped and rescanned. A blob found
+// at a stale location with another copy elsewhere is pointed at that
+// copy instead; one without any copy has vanished, and is returned
+// for Forget. Blobs found elsewhere are left alone, since indexes
+// built before copies were tracked have none.
+func (d *DB) Reconcile(stale func(ref, location string) bool) (vanished map[string]bool, repointed int, err error) {
+	snap, err := d.db.GetSnapshot()
+	if err != nil {
+		return
+	}
+	defer snap.Release()
+	founds := snap.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer founds.Release()
+	copyIt := snap.NewIterator(&util.Range{
+		Start: pack(copies, start),
+		Limit: pack(copies, limit),
+	}, nil)
+	defer copyIt.Release()
+
+	vanished = make(map[string]bool)
+	b := new(leveldb.Batch)
+	moreCopies := copyIt.Next()
+	for founds.Next() {
+		ref := unpack(founds.Key())[1]
+		// both keyspaces are ordered by ref
+		var locations []string
+		for moreCopies {
+			parts := unpack(copyIt.Key())
+			if parts[1] > ref {
+				break
+			}
+			if parts[1] == ref {
+				locations = append(locations, parts[2])
+			}
+			moreCopies = copyIt.Next()
+		}
+		location, size, ct := unpackFound(founds.Value())
+		if location == "" || !stale(ref, location) {
+			continue
+		}
+		current := false
+		for _, l := range locations {
+			current = current || l == location
+		}
+		switch {
+		case current:
+		case len(locations) == 0:
+			vanished[ref] = true
+		default:
+			b.Put(founds.Key(), pack(locations[len(locations)-1], formatSize(size), ct))
+			repointed++
+			if b.Len() >= batchSize {
+				if err = d.db.Write(b, nil); err != nil {
+					return
+				}
+				b.Reset()
+			}
+		}
+	}
+	for _, it := range []iterator.Iterator{founds, copyIt} {
+		if err = it.Error(); err != nil {
+			return
+		}
+	}
+	err = d.db.Write(b, nil)
+	return
+}
+
+// Forget removes blobs that are no longer in the blobstore from the
+// index: their found, type, copy, verified and MIME entries, the
+// parent edges and claims they contributed, and then re-derives the
+// missing entries, so that blobs still referencing them report them
+// missing. A permanode whose camliContent claim is forgotten is
+// moved back to the content its remaining claims give it.
+func (d *DB) Forget(refs map[string]bool) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	b := new(leveldb.Batch)
+	flush := func(min int) error {
+		if b.Len() < min {
+			return nil
+		}
+		err := d.db.Write(b, nil)
+		b.Reset()
+		return err
+	}
+	for ref := range refs {
+		switch data, err := d.db.Get(pack(found, ref), nil); err {
+		case nil:
+			if _, _, ct := unpackFound(data); ct != "" {
+				b.Delete(pack(camliType, ct, ref))
+			}
+			b.Delete(pack(found, ref))
+			b.Delete(pack(verified, ref))
+		case leveldb.ErrNotFound:
+		default:
+			return err
+		}
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(copies, ref, start),
+			Limit: pack(copies, ref, limit),
+		}, nil)
+		for it.Next() {
+			b.Delete(it.Key())
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return err
+		}
+		if err := flush(batchSize); err != nil {
+			return err
+		}
+	}
+	// camliContent values of forgotten claims, by permanode
+	contents := make(map[string][]string)
+	// these keyspaces aren't ordered by the forgotten ref, so each
+	// takes a pass.
+	for _, ks := range []struct {
+		prefix string
+		field  int
+	}{
+		{mimeType, 2},
+		{parent, 2},
+		{missing, 2},
+		{claim, 3},
+		{signers, 2},
+	} {
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(ks.prefix, start),
+			Limit: pack(ks.prefix, limit),
+		}, nil)
+		for it.Next() {
+			if parts := unpack(it.Key()); len(parts) > ks.field && refs[parts[ks.field]] {
+				if ks.prefix == claim {
+					if v := unpack(it.Value()); len(v) == 3 && v[1] == "camliContent" && v[2] != "" {
+						contents[parts[1]] = append(contents[parts[1]], v[2])
+					}
+				}
+				b.Delete(it.Key())
+				if err := flush(batchSize); err != nil {
+					it.Release()
+					return err
+				}
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return err
+		}
+	}
+	if err := flush(1); err != nil {
+		return err
+	}
+	// the permanode is a parent of whatever the remaining claims
+	// make its content, and nothing else.
+	for permanode, values := range contents {
+		if refs[permanode] {
+			continue
+		}
+		claims, err := d.Claims(permanode)
+		if err != nil {
+			return err
+		}
+		current := attributeValue(claims, "camliContent")
+		for _, v := range values {
+			if v != current {
+				b.Delete(pack(parent, v, permanode))
+			}
+		}
+		if current != "" {
+			b.Put(pack(parent, current, permanode), nil)
+		}
+		if err := flush(batchSize); err != nil {
+			return err
+		}
+	}
+	if err := flush(1); err != nil {
+		return err
+	}
+	_, _, err := d.ResolveMissing()
+	return err
+}
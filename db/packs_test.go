@@ -0,0 +1,181 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestForget(t *testing.T) {
+	t0 := time.Unix(1400000000, 0)
+	content := func(ref string, hours int, value string) Claim {
+		return Claim{
+			Ref:       ref,
+			Permanode: "p",
+			Date:      t0.Add(time.Duration(hours) * time.Hour),
+			Type:      "set-attribute",
+			Attribute: "camliContent",
+			Value:     value,
+		}
+	}
+	for _, test := range []struct {
+		name   string
+		forget []string
+		// keys left under each prefix
+		want map[string][]string
+	}{
+		{
+			name: "nothing",
+			want: map[string][]string{
+				found:     {"found|a", "found|b", "found|c1", "found|c2", "found|f", "found|p"},
+				parent:    {"parent|b|p", "parent|f|a"},
+				missing:   nil,
+				camliType: {"type|claim|c1", "type|claim|c2", "type|file|a", "type|file|b", "type|permanode|p"},
+			},
+		},
+		{
+			name:   "referenced blob reported missing",
+			forget: []string{"f"},
+			want: map[string][]string{
+				found:   {"found|a", "found|b", "found|c1", "found|c2", "found|p"},
+				parent:  {"parent|b|p", "parent|f|a"},
+				missing: {"missing|f|a"},
+				copies:  {"copy|a|0 1", "copy|b|0 2", "copy|c1|0 4", "copy|c2|0 5", "copy|p|0 3"},
+			},
+		},
+		{
+			name:   "parent forgotten",
+			forget: []string{"a"},
+			want: map[string][]string{
+				found:     {"found|b", "found|c1", "found|c2", "found|f", "found|p"},
+				parent:    {"parent|b|p"},
+				missing:   nil,
+				camliType: {"type|claim|c1", "type|claim|c2", "type|file|b", "type|permanode|p"},
+			},
+		},
+		{
+			name:   "content claim reverts",
+			forget: []string{"c2"},
+			want: map[string][]string{
+				parent: {"parent|a|p", "parent|f|a"},
+				claim:  {"claim|p|2014-05-13T16:53:20.000000000Z|c1"},
+			},
+		},
+		{
+			name:   "current content reported missing",
+			forget: []string{"b"},
+			want: map[string][]string{
+				parent:  {"parent|b|p", "parent|f|a"},
+				missing: {"missing|b|p"},
+			},
+		},
+		{
+			name:   "never found",
+			forget: []string{"z"},
+			want: map[string][]string{
+				found:   {"found|a", "found|b", "found|c1", "found|c2", "found|f", "found|p"},
+				missing: nil,
+			},
+		},
+	} {
+		d := newTestDB(t)
+		for _, c := range []Claim{content("c1", 0, "a"), content("c2", 1, "b")} {
+			if err := d.PlaceClaim(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		placeAll(t, d, false,
+			placed{ref: "f", location: "0 0"},
+			placed{ref: "a", location: "0 1", ct: "file", deps: []string{"f"}},
+			placed{ref: "b", location: "0 2", ct: "file"},
+			placed{ref: "p", location: "0 3", ct: "permanode"},
+			placed{ref: "c1", location: "0 4", ct: "claim"},
+			placed{ref: "c2", location: "0 5", ct: "claim"},
+		)
+		refs := make(map[string]bool)
+		for _, r := range test.forget {
+			refs[r] = true
+		}
+		if err := d.Forget(refs); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		for prefix, want := range test.want {
+			if got := keys(t, d, prefix); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s %q, want %q", test.name, prefix, got, want)
+			}
+		}
+		d.Close()
+	}
+}
+
+func TestDropLocationsReconcile(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		stale func(ref, location string) bool
+		// copy entries left after dropping
+		copies    []string
+		dropped   int
+		vanished  map[string]bool
+		repointed int
+		// found location of each blob left
+		found map[string]string
+	}{
+		{
+			name: "gone copies",
+			stale: func(ref, location string) bool {
+				return ref == "a" && location == "0 5" || ref == "c" && location == "2 0"
+			},
+			copies:    []string{"copy|a|1 0", "copy|b|0 5"},
+			dropped:   3,
+			vanished:  map[string]bool{"c": true},
+			repointed: 1,
+			found:     map[string]string{"a": "1 0", "b": "0 5"},
+		},
+		{
+			name: "rewritten pack",
+			stale: func(_, location string) bool {
+				return location[0] == '0'
+			},
+			copies:    []string{"copy|a|1 0", "copy|c|2 0"},
+			dropped:   3,
+			vanished:  map[string]bool{"b": true},
+			repointed: 1,
+			found:     map[string]string{"a": "1 0", "c": "2 0"},
+		},
+	} {
+		d := newTestDB(t)
+		placeAll(t, d, false,
+			placed{ref: "a", location: "1 0"},
+			// a was at 0 5 before b was written there
+			placed{ref: "a", location: "0 5"},
+			placed{ref: "b", location: "0 5"},
+			placed{ref: "c", location: "2 0"},
+		)
+		if err := d.PlaceCorrupt("a", "0 5", 1); err != nil {
+			t.Fatal(err)
+		}
+		dropped, err := d.DropLocations(test.stale)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := keys(t, d, copies); !reflect.DeepEqual(got, test.copies) || dropped != test.dropped {
+			t.Errorf("%s: dropped %d, leaving %q, want %d, %q", test.name, dropped, got, test.dropped, test.copies)
+		}
+		if got := keys(t, d, corrupt); len(got) != 0 {
+			t.Errorf("%s: corrupt %q", test.name, got)
+		}
+		vanished, repointed, err := d.Reconcile(test.stale)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(vanished, test.vanished) || repointed != test.repointed {
+			t.Errorf("%s: vanished %v, repointed %d, want %v, %d", test.name, vanished, repointed, test.vanished, test.repointed)
+		}
+		for ref, want := range test.found {
+			if b, ok, err := d.Lookup(ref); err != nil || !ok || b.Location != want {
+				t.Errorf("%s: %s found at %q (%v, %v), want %q", test.name, ref, b.Location, ok, err, want)
+			}
+		}
+		d.Close()
+	}
+}
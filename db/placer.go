@@ -0,0 +1,212 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Placer accumulates placed blobs into batches, writing each batch
+// once it holds enough blobs or bytes of blob content. The resume
+// marker is written along with each batch, so it never passes a blob
+// that hasn't been written. Blobs placed in the pending batch are
+// taken into account when resolving missing blobs.
+type Placer struct {
+	d          *DB
+	inline     bool
+	maxBlobs   int
+	maxBytes   uint64
+	b          *leveldb.Batch
+	blobs      int
+	bytes      uint64
+	last       string
+	noResume   bool
+	found      map[string]bool
+	missing    map[string][]string
+	claims     map[string][]Claim
+	mu         sync.Mutex
+	start      time.Time
+	totalBlobs uint64
+	totalBytes uint64
+	batches    uint64
+}
+
+// NewPlacer returns a Placer that writes a batch once it holds
+// maxBlobs blobs or maxBytes bytes of blob content. If deferMissing
+// is set, dependencies are only recorded as parent edges, leaving the
+// missing entries to be computed by ResolveMissing once all blobs have
+// been placed.
+func (d *DB) NewPlacer(maxBlobs int, maxBytes uint64, deferMissing bool) *Placer {
+	p := d.newPlacer(!deferMissing)
+	p.maxBlobs, p.maxBytes = maxBlobs, maxBytes
+	return p
+}
+
+func (d *DB) newPlacer(inline bool) *Placer {
+	return &Placer{
+		d:       d,
+		inline:  inline,
+		b:       new(leveldb.Batch),
+		found:   make(map[string]bool),
+		missing: make(map[string][]string),
+		claims:  make(map[string][]Claim),
+		start:   time.Now(),
+	}
+}
+
+// Place notes the presence of a blob at a particular location, once
+// the batch is full.
+func (p *Placer) Place(ref, location, ct string, size uint32, dependencies []string) error {
+	b := p.b
+	// found points at the most recently seen copy; every copy,
+	// including duplicates, is kept under copies.
+	b.Put(pack(found, ref), pack(location, formatSize(size), ct))
+	if location != "" {
+		b.Put(pack(copies, ref, location), pack(formatSize(size)))
+		p.last = location
+	}
+	if ct != "" {
+		b.Put(pack(camliType, ct, ref), pack(formatSize(size)))
+	}
+	for _, dep := range dependencies {
+		b.Put(pack(parent, dep, ref), nil)
+		if p.inline {
+			p.checkMissing(dep, ref)
+		}
+	}
+	if p.inline {
+		p.found[ref] = true
+		for _, parent := range p.missing[ref] {
+			b.Delete(pack(missing, ref, parent))
+		}
+		delete(p.missing, ref)
+		it := p.d.db.NewIterator(&util.Range{
+			Start: pack(missing, ref, start),
+			Limit: pack(missing, ref, limit),
+		}, nil)
+		defer it.Release()
+		for it.Next() {
+			b.Delete(it.Key())
+		}
+		if err := it.Error(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return p.added(size)
+}
+
+// SkipResume stops the Placer from writing the resume marker, for
+// blobs placed out of stream order, such as by rescanning a single
+// pack, which would otherwise move the marker back.
+func (p *Placer) SkipResume() {
+	p.noResume = true
+}
+
+// PlaceClaim is like DB.PlaceClaim, but only writes once the batch
+// is full. As with DB.PlaceClaim, the claim should be placed before
+// the claim blob itself.
+func (p *Placer) PlaceClaim(c Claim) error {
+	p.b.Put(pack(claim, c.Permanode, c.Date.UTC().Format(claimDate), c.Ref),
+		pack(c.Type, c.Attribute, c.Value))
+	if c.Attribute != "camliContent" {
+		return nil
+	}
+	// claims arrive in blobstore order, not date order, so the
+	// current content is found by replaying every claim, including
+	// those still pending.
+	claims, err := p.d.Claims(c.Permanode)
+	if err != nil {
+		return err
+	}
+	p.claims[c.Permanode] = append(p.claims[c.Permanode], c)
+	claims = append(claims, p.claims[c.Permanode]...)
+	sort.Stable(byDate(claims))
+	current := attributeValue(claims, "camliContent")
+	for _, old := range claims {
+		if old.Attribute == "camliContent" && old.Value != "" && old.Value != current {
+			p.b.Delete(pack(parent, old.Value, c.Permanode))
+			p.b.Delete(pack(missing, old.Value, c.Permanode))
+		}
+	}
+	if current != "" {
+		p.b.Put(pack(parent, current, c.Permanode), nil)
+		if p.inline {
+			p.checkMissing(current, c.Permanode)
+		}
+	}
+	return nil
+}
+
+// PlaceCorrupt is like DB.PlaceCorrupt, but only writes once the
+// batch is full.
+func (p *Placer) PlaceCorrupt(ref, location string, size uint32) error {
+	p.b.Put(pack(corrupt, ref, location), pack(formatSize(size)))
+	p.last = location
+	return p.added(size)
+}
+
+// PlaceSigner is like DB.PlaceSigner, but only writes with the
+// batch.
+func (p *Placer) PlaceSigner(signer, signed string) {
+	p.b.Put(pack(signers, signer, signed), nil)
+}
+
+// checkMissing notes that dep is missing from parent, unless it has
+// been found.
+func (p *Placer) checkMissing(dep, parent string) {
+	if p.found[dep] {
+		return
+	}
+	if ok, _ := p.d.db.Has(pack(found, dep), nil); ok {
+		return
+	}
+	p.b.Put(pack(missing, dep, parent), nil)
+	p.missing[dep] = append(p.missing[dep], parent)
+}
+
+func (p *Placer) added(size uint32) error {
+	p.blobs++
+	p.bytes += uint64(size)
+	if p.blobs >= p.maxBlobs || p.bytes >= p.maxBytes {
+		return p.Flush()
+	}
+	return nil
+}
+
+// Flush writes the pending batch.
+func (p *Placer) Flush() error {
+	if p.b.Len() == 0 {
+		return nil
+	}
+	if p.last != "" && !p.noResume {
+		p.b.Put(pack(last), pack(p.last))
+	}
+	if err := p.d.db.Write(p.b, nil); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.totalBlobs += uint64(p.blobs)
+	p.totalBytes += p.bytes
+	p.batches++
+	p.mu.Unlock()
+	p.b.Reset()
+	p.blobs, p.bytes, p.last = 0, 0, ""
+	p.found = make(map[string]bool)
+	p.missing = make(map[string][]string)
+	p.claims = make(map[string][]Claim)
+	return nil
+}
+
+// String reports the throughput of written batches.
+func (p *Placer) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	secs := time.Since(p.start).Seconds()
+	return fmt.Sprintf("placed %d blobs (%d bytes) in %d batches: %.0f blobs/s, %.0f bytes/s",
+		p.totalBlobs, p.totalBytes, p.batches,
+		float64(p.totalBlobs)/secs, float64(p.totalBytes)/secs)
+}
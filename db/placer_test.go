@@ -0,0 +1,133 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlaceClaimContent(t *testing.T) {
+	t0 := time.Unix(1400000000, 0)
+	set := func(ref string, hours int, value string) Claim {
+		return Claim{
+			Ref:       ref,
+			Permanode: "p",
+			Date:      t0.Add(time.Duration(hours) * time.Hour),
+			Type:      "set-attribute",
+			Attribute: "camliContent",
+			Value:     value,
+		}
+	}
+	del := set("c9", 9, "")
+	del.Type = "del-attribute"
+	for _, test := range []struct {
+		name   string
+		claims []Claim
+		want   []string
+	}{
+		{
+			name:   "single",
+			claims: []Claim{set("c1", 1, "a")},
+			want:   []string{"parent|a|p"},
+		},
+		{
+			name:   "in order",
+			claims: []Claim{set("c1", 1, "a"), set("c2", 2, "b")},
+			want:   []string{"parent|b|p"},
+		},
+		{
+			name:   "newest first",
+			claims: []Claim{set("c2", 2, "b"), set("c1", 1, "a")},
+			want:   []string{"parent|b|p"},
+		},
+		{
+			name:   "newest in the middle",
+			claims: []Claim{set("c1", 1, "a"), set("c3", 3, "c"), set("c2", 2, "b")},
+			want:   []string{"parent|c|p"},
+		},
+		{
+			name:   "deleted",
+			claims: []Claim{set("c1", 1, "a"), del},
+		},
+		{
+			name:   "set after delete",
+			claims: []Claim{del, set("c1", 1, "a"), set("c10", 10, "b")},
+			want:   []string{"parent|b|p"},
+		},
+	} {
+		// every claim in one batch, and each in its own
+		for _, batch := range []int{100, 1} {
+			d := newTestDB(t)
+			p := d.NewPlacer(batch, 1<<30, false)
+			for _, c := range test.claims {
+				if err := p.PlaceClaim(c); err != nil {
+					t.Fatal(err)
+				}
+				if err := p.Place(c.Ref, "0 0", "claim", 1, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := p.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if got := keys(t, d, parent); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s, batch %d: parents %q, want %q", test.name, batch, got, test.want)
+			}
+			// the content was never found
+			var wantMissing []string
+			for _, k := range test.want {
+				wantMissing = append(wantMissing, "missing"+k[len("parent"):])
+			}
+			if got := keys(t, d, missing); !reflect.DeepEqual(got, wantMissing) {
+				t.Errorf("%s, batch %d: missing %q, want %q", test.name, batch, got, wantMissing)
+			}
+			d.Close()
+		}
+	}
+}
+
+func TestClaims(t *testing.T) {
+	d := newTestDB(t)
+	defer d.Close()
+	t0 := time.Unix(1400000000, 0).UTC()
+	claims := []Claim{
+		{Ref: "c2", Permanode: "p", Date: t0.Add(time.Minute), Type: "set-attribute", Attribute: "title", Value: "new"},
+		{Ref: "c1", Permanode: "p", Date: t0, Type: "set-attribute", Attribute: "title", Value: "old"},
+		{Ref: "c3", Permanode: "q", Date: t0, Type: "set-attribute", Attribute: "title", Value: "other"},
+	}
+	for _, c := range claims {
+		if err := d.PlaceClaim(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := d.Claims("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Claim{claims[1], claims[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("claims %v, want %v", got, want)
+	}
+	if title, err := d.Attribute("p", "title"); err != nil || title != "new" {
+		t.Errorf("title %q, %v", title, err)
+	}
+}
+
+func TestSkipResume(t *testing.T) {
+	d := newTestDB(t)
+	defer d.Close()
+	p := d.NewPlacer(1, 1<<30, false)
+	if err := p.Place("a", "3 100", "", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a rescan of an earlier pack
+	p.SkipResume()
+	if err := p.Place("b", "1 0", "", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Last(); got != "3 100" {
+		t.Errorf("resume marker %q, want %q", got, "3 100")
+	}
+}
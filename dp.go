@@ -3,17 +3,31 @@ package main
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"camlistore.org/pkg/blob"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/blobserver/dir"
+	"camlistore.org/pkg/blobserver/diskpacked"
+	"camlistore.org/pkg/context"
 	"github.com/gonuts/commander"
 
+	"github.com/dichro/cameloff/db"
 	"github.com/dichro/cameloff/fsck"
 )
 
@@ -48,6 +62,7 @@ func (f *Flag) Get() interface{} {
 func main() {
 	bs := Flag{}
 
+	var prettySchema bool
 	cat := &commander.Command{
 		UsageLine: "cat prints blob contents",
 		Run: func(cmd *commander.Command, args []string) error {
@@ -65,15 +80,24 @@ func main() {
 					fmt.Fprintf(os.Stderr, "%s: %s\n", ref, err)
 					continue
 				}
-				io.Copy(os.Stdout, blob)
+				if prettySchema {
+					err = catSchema(os.Stdout, br, blob)
+				} else {
+					_, err = io.Copy(os.Stdout, blob)
+				}
 				blob.Close()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", ref, err)
+				}
 			}
 			return nil
 		},
 	}
+	cat.Flag.BoolVar(&prettySchema, "schema", false, "Pretty-print schema blobs")
 
+	var salvage bool
 	tar := &commander.Command{
-		UsageLine: "tar exports files from the blobstore",
+		UsageLine: "tar exports files and directories from the blobstore",
 		Run: func(cmd *commander.Command, args []string) error {
 			if bs.BS == nil {
 				return errors.New("require --blob_dir")
@@ -81,19 +105,25 @@ func main() {
 			files := fsck.NewFiles(bs.BS)
 			go files.LogErrors()
 
-			// read blobrefs from stdin
-			refsCh := make(chan string, 20)
+			// read blobrefs, each optionally followed by a path,
+			// from stdin
+			treesCh := make(chan fsck.Tree, 20)
 			go func() {
 				in := bufio.NewScanner(os.Stdin)
 				for in.Scan() {
 					// TODO(dichro): validate ref?
-					refsCh <- in.Text()
+					fields := strings.SplitN(strings.TrimSpace(in.Text()), " ", 2)
+					t := fsck.Tree{Ref: fields[0]}
+					if len(fields) == 2 {
+						t.Path = strings.TrimLeft(path.Clean(fields[1]), "/")
+					}
+					treesCh <- t
 				}
-				close(refsCh)
+				close(treesCh)
 			}()
 
 			go func() {
-				files.ReadRefs(refsCh)
+				files.ReadTrees(treesCh)
 				files.Close()
 			}()
 
@@ -101,18 +131,56 @@ func main() {
 			defer out.Flush()
 
 			for r := range files.Readers {
-				size := r.PartsSize()
-				if err := out.WriteHeader(&tar.Header{
-					Name:     r.FileName(),
-					Mode:     int64(r.FileMode()),
-					Uid:      r.MapUid(),
-					Gid:      r.MapGid(),
-					Size:     size,
-					ModTime:  r.ModTime(),
-					Typeflag: tar.TypeReg,
-				}); err != nil {
+				hdr := &tar.Header{
+					Name:    r.Path,
+					Mode:    tarMode(r.FileMode()),
+					Uid:     r.MapUid(),
+					Gid:     r.MapGid(),
+					ModTime: r.ModTime(),
+				}
+				switch r.Type() {
+				case "directory":
+					hdr.Name += "/"
+					hdr.Typeflag = tar.TypeDir
+				case "symlink":
+					target, ok := fsck.SymlinkTarget(r.Blob)
+					if !ok {
+						log.Printf("%s: %s: no symlink target", r.BlobRef(), r.Path)
+						continue
+					}
+					hdr.Typeflag = tar.TypeSymlink
+					hdr.Linkname = target
+				case "fifo":
+					hdr.Typeflag = tar.TypeFifo
+				case "socket":
+					// sockets can't be archived; they're
+					// recreated by whatever listens on them
+					log.Printf("%s: %s: skipping socket", r.BlobRef(), r.Path)
+					continue
+				default:
+					hdr.Typeflag = tar.TypeReg
+					hdr.Size = r.PartsSize()
+				}
+				if err := out.WriteHeader(hdr); err != nil {
 					log.Fatal(err)
 				}
+				if r.ReadSeeker == nil {
+					continue
+				}
+				size := hdr.Size
+				if salvage {
+					holes, err := fsck.Salvage(out, bs.BS, r.Blob)
+					if err != nil {
+						log.Fatal(err)
+					}
+					if len(holes) > 0 {
+						log.Printf("%s: %s: %d holes", r.BlobRef(), r.Path, len(holes))
+						if err := writeHoles(out, r, holes); err != nil {
+							log.Fatal(err)
+						}
+					}
+					continue
+				}
 				switch n, err := io.Copy(out, r); {
 				case err != nil:
 					log.Fatal(err)
@@ -123,12 +191,142 @@ func main() {
 			return nil
 		},
 	}
+	tar.Flag.BoolVar(&salvage, "salvage", false, "Export damaged files with missing contents zero-filled, each followed by a .holes report")
+
+	var resume, prefix, lsFormat string
+	var minSize, maxSize uint64
+	ls := &commander.Command{
+		UsageLine: "ls lists the blobs in the blobstore",
+		Run: func(cmd *commander.Command, args []string) error {
+			if bs.BS == nil {
+				return errors.New("require --blob_dir")
+			}
+			if lsFormat != "text" && lsFormat != "jsonl" {
+				return fmt.Errorf("unknown format %q, use \"text\" or \"jsonl\"", lsFormat)
+			}
+			return listBlobs(bs.BS, resume, blobFilter{
+				prefix:  prefix,
+				minSize: minSize,
+				maxSize: maxSize,
+			}, lsFormat == "jsonl")
+		},
+	}
+	ls.Flag.StringVar(&resume, "resume", "", "Token to resume listing from")
+	ls.Flag.StringVar(&prefix, "prefix", "", "Only list refs starting with this prefix")
+	ls.Flag.Uint64Var(&minSize, "min_size", 0, "Only list blobs of at least this many bytes")
+	ls.Flag.Uint64Var(&maxSize, "max_size", 0, "Only list blobs of at most this many bytes, if non-zero")
+	ls.Flag.StringVar(&lsFormat, "format", "text", "Output format: text, or jsonl for one JSON object per line")
+
+	var chown, verify bool
+	extract := &commander.Command{
+		UsageLine: "extract restores a file, directory or static-set to a local directory",
+		Run: func(cmd *commander.Command, args []string) error {
+			if bs.BS == nil {
+				return errors.New("require --blob_dir")
+			}
+			if len(args) != 2 {
+				return errors.New("require a ref and a destination directory")
+			}
+			return extractTree(bs.BS, args[0], args[1], chown, verify)
+		},
+	}
+	extract.Flag.BoolVar(&chown, "chown", false, "Restore file ownership")
+	extract.Flag.BoolVar(&verify, "verify", false, "Verify the contents of files already present instead of trusting their size and mtime")
+
+	var dbDir string
+	inspect := &commander.Command{
+		UsageLine: "inspect describes blobs",
+		Run: func(cmd *commander.Command, args []string) error {
+			if bs.BS == nil {
+				return errors.New("require --blob_dir")
+			}
+			var idx *db.DB
+			if dbDir != "" {
+				var err error
+				if idx, err = db.NewRO(dbDir); err != nil {
+					return err
+				}
+				defer idx.Close()
+			}
+			for _, ref := range args {
+				br, ok := blob.Parse(ref)
+				if !ok {
+					fmt.Fprintf(os.Stderr, "%s: couldn't parse ref\n", ref)
+					continue
+				}
+				if err := inspectBlob(os.Stdout, bs.BS, idx, br); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", ref, err)
+				}
+			}
+			return nil
+		},
+	}
+	inspect.Flag.StringVar(&dbDir, "db_dir", "", "FSCK state database directory, for locations and parents")
+
+	var listen string
+	serve := &commander.Command{
+		UsageLine: "serve browses the blobstore over HTTP",
+		Run: func(cmd *commander.Command, args []string) error {
+			if bs.BS == nil {
+				return errors.New("require --blob_dir")
+			}
+			srv := &server{bs: bs.BS}
+			if dbDir != "" {
+				idx, err := db.NewRO(dbDir)
+				if err != nil {
+					return err
+				}
+				defer idx.Close()
+				srv.db = idx
+			}
+			log.Printf("serving on http://%s/", listen)
+			return http.ListenAndServe(listen, srv.handler())
+		},
+	}
+	serve.Flag.StringVar(&listen, "listen", "localhost:3179", "Address to serve on")
+	serve.Flag.StringVar(&dbDir, "db_dir", "", "FSCK state database directory, for index status")
+
+	var dropFile, keepFile string
+	compact := &commander.Command{
+		UsageLine: "compact copies the blobstore without dropped or corrupt blobs",
+		Run: func(cmd *commander.Command, args []string) error {
+			if bs.BS == nil {
+				return errors.New("require --blob_dir")
+			}
+			if len(args) != 1 {
+				return errors.New("require a destination directory")
+			}
+			if dropFile != "" && keepFile != "" {
+				return errors.New("--drop and --keep are mutually exclusive")
+			}
+			refs, keep := map[string]bool{}, false
+			var err error
+			switch {
+			case dropFile != "":
+				refs, err = readRefs(dropFile)
+			case keepFile != "":
+				refs, err = readRefs(keepFile)
+				keep = true
+			}
+			if err != nil {
+				return err
+			}
+			return compactBlobs(bs.BS, args[0], refs, keep)
+		},
+	}
+	compact.Flag.StringVar(&dropFile, "drop", "", "File of refs to drop, one per line")
+	compact.Flag.StringVar(&keepFile, "keep", "", "File of refs to keep, one per line")
 
 	top := &commander.Command{
 		UsageLine: os.Args[0],
 		Subcommands: []*commander.Command{
 			cat,
+			ls,
+			inspect,
 			tar,
+			extract,
+			serve,
+			compact,
 		},
 	}
 
@@ -140,3 +338,826 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// writeHoles adds a report of the zero-filled holes in a salvaged
+// file to the archive, named after the file.
+func writeHoles(out *tar.Writer, f fsck.File, holes []fsck.Range) error {
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "# %s: zero-filled byte ranges\n", f.BlobRef())
+	for _, h := range holes {
+		fmt.Fprintln(&report, h)
+	}
+	if err := out.WriteHeader(&tar.Header{
+		Name:     f.Path + ".holes",
+		Mode:     0644,
+		Size:     int64(report.Len()),
+		ModTime:  f.ModTime(),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := report.WriteTo(out)
+	return err
+}
+
+// extractTree restores the tree rooted at ref into dest. Files are
+// written to a temporary name, and only renamed into place once all
+// of their contents have been fetched and checked against their
+// refs, so a file already present with the expected size and mtime
+// is complete and is skipped, unless verify is set.
+func extractTree(fetcher blob.Fetcher, ref, dest string, chown, verify bool) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	files := fsck.NewFiles(fetcher)
+
+	treesCh := make(chan fsck.Tree, 1)
+	treesCh <- fsck.Tree{Ref: ref}
+	close(treesCh)
+	go func() {
+		files.ReadTrees(treesCh)
+		files.Close()
+	}()
+
+	stats := fsck.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
+	failed := 0
+	fail := func(what string, err error) {
+		log.Printf("%s: %s", what, err)
+		stats.Add("failed")
+		failed++
+	}
+	// symlinks are only created once everything else is written, so
+	// that nothing is written through them, and directory modes and
+	// mtimes are restored last, since writing their contents changes
+	// them.
+	var symlinks, dirs []fsck.File
+	for readers := files.Readers; readers != nil; {
+		var r fsck.File
+		select {
+		case ref := <-files.Missing:
+			fail(ref, errors.New("missing"))
+			continue
+		case ref := <-files.Invalid:
+			fail(ref, errors.New("unparseable schema blob"))
+			continue
+		case ref := <-files.Unreadable:
+			fail(ref, errors.New("unreadable"))
+			continue
+		case f, ok := <-readers:
+			if !ok {
+				readers = nil
+				continue
+			}
+			r = f
+		}
+		p, err := extractPath(dest, r.Path)
+		if err != nil {
+			fail(r.BlobRef().String()+": "+r.Path, err)
+			continue
+		}
+		switch r.Type() {
+		case "directory":
+			err = extractDir(p)
+			if err == nil {
+				dirs = append(dirs, r)
+				stats.Add("directory")
+				continue
+			}
+		case "symlink":
+			symlinks = append(symlinks, r)
+			continue
+		case "fifo":
+			os.Remove(p)
+			err = syscall.Mkfifo(p, 0600)
+		case "socket":
+			log.Printf("%s: %s: skipping socket", r.BlobRef(), r.Path)
+			stats.Add("socket")
+			continue
+		default:
+			var done bool
+			switch done, err = complete(p, fetcher, r, verify); {
+			case err != nil:
+			case done:
+				stats.Add("complete")
+				continue
+			default:
+				err = extractFile(p, fetcher, r)
+			}
+		}
+		if err == nil {
+			err = restoreAttrs(p, r, chown)
+		}
+		if err != nil {
+			fail(r.BlobRef().String()+": "+r.Path, err)
+			continue
+		}
+		stats.Add(r.Type())
+	}
+	for _, r := range symlinks {
+		p, err := extractPath(dest, r.Path)
+		if err == nil {
+			err = extractSymlink(p, r)
+		}
+		if err == nil {
+			err = restoreAttrs(p, r, chown)
+		}
+		if err != nil {
+			fail(r.BlobRef().String()+": "+r.Path, err)
+			continue
+		}
+		stats.Add("symlink")
+	}
+	// children before parents, so restrictive modes don't get in
+	// the way.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		r := dirs[i]
+		p, err := extractPath(dest, r.Path)
+		if err == nil {
+			if fi, lerr := os.Lstat(p); lerr != nil || !fi.IsDir() {
+				err = errors.New("no longer a directory")
+			}
+		}
+		if err == nil {
+			err = restoreAttrs(p, r, chown)
+		}
+		if err != nil {
+			fail(r.BlobRef().String()+": "+r.Path, err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d entries failed", failed)
+	}
+	return nil
+}
+
+// extractPath returns the location under dest of the tree entry at
+// rel, refusing entries that would land outside of dest, whether by
+// their names or through symlinks already in dest.
+func extractPath(dest, rel string) (string, error) {
+	rel = filepath.Clean(filepath.FromSlash(rel))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("path outside of destination")
+	}
+	p := dest
+	for _, name := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if name == "." {
+			continue
+		}
+		p = filepath.Join(p, name)
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symlink", p)
+		}
+	}
+	return filepath.Join(dest, rel), nil
+}
+
+// extractDir creates the directory at p, replacing any symlink, and
+// makes sure it's writable, since a previous restore may have left
+// it read-only.
+func extractDir(p string) error {
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(p, 0700); err != nil {
+		return err
+	}
+	return os.Chmod(p, 0700)
+}
+
+// complete reports whether the file at p already holds the contents
+// of f.
+func complete(p string, fetcher blob.Fetcher, f fsck.File, verify bool) (bool, error) {
+	fi, err := os.Lstat(p)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	case !fi.Mode().IsRegular() || fi.Size() != f.PartsSize():
+		return false, nil
+	case !f.ModTime().IsZero() && !fi.ModTime().Equal(f.ModTime()):
+		return false, nil
+	case !verify:
+		return true, nil
+	}
+	in, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	ok, holes, err := fsck.Verify(bufio.NewReader(in), fetcher, f.Blob)
+	if len(holes) > 0 {
+		log.Printf("%s: %s: %d holes, can't verify", f.BlobRef(), f.Path, len(holes))
+	}
+	return ok, err
+}
+
+// extractFile writes the contents of f to p, failing if any of them
+// are missing or corrupt.
+func extractFile(p string, fetcher blob.Fetcher, f fsck.File) error {
+	tmp := p + ".dp-extract"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(out)
+	holes, err := fsck.Salvage(w, fetcher, f.Blob)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case err != nil:
+		return err
+	case len(holes) > 0:
+		return fmt.Errorf("damaged: %d holes", len(holes))
+	}
+	return os.Rename(tmp, p)
+}
+
+// extractSymlink creates a symlink at p, unless one with the right
+// target is already there.
+func extractSymlink(p string, f fsck.File) error {
+	target, ok := fsck.SymlinkTarget(f.Blob)
+	if !ok {
+		return errors.New("no symlink target")
+	}
+	if existing, err := os.Readlink(p); err == nil && existing == target {
+		return nil
+	}
+	os.Remove(p)
+	return os.Symlink(target, p)
+}
+
+// restoreAttrs sets the mode, mtime and optionally ownership of p
+// from f. Symlinks only get their ownership restored.
+func restoreAttrs(p string, f fsck.File, chown bool) error {
+	if chown {
+		if err := os.Lchown(p, f.MapUid(), f.MapGid()); err != nil {
+			return err
+		}
+	}
+	if f.Type() == "symlink" {
+		return nil
+	}
+	mode := f.FileMode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(p, mode); err != nil {
+		return err
+	}
+	if mtime := f.ModTime(); !mtime.IsZero() {
+		return os.Chtimes(p, mtime, mtime)
+	}
+	return nil
+}
+
+// blobFilter selects blobs by ref prefix and size.
+type blobFilter struct {
+	prefix           string
+	minSize, maxSize uint64
+}
+
+func (f blobFilter) match(ref string, size uint32) bool {
+	switch {
+	case !strings.HasPrefix(ref, f.prefix):
+		return false
+	case uint64(size) < f.minSize:
+		return false
+	case f.maxSize > 0 && uint64(size) > f.maxSize:
+		return false
+	}
+	return true
+}
+
+// listedBlob is a line of "dp ls" output.
+type listedBlob struct {
+	Ref   string
+	Size  uint32
+	Token string
+	Valid bool
+}
+
+// listBlobs streams the blobs in bs from resume, printing those that
+// match filter, with their location tokens and whether their
+// contents match their refs.
+func listBlobs(bs blobserver.Storage, resume string, filter blobFilter, asJSON bool) error {
+	streamer, ok := bs.(blobserver.BlobStreamer)
+	if !ok {
+		return errors.New("not a BlobStreamer")
+	}
+	ch := make(chan blobserver.BlobAndToken, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- streamer.StreamBlobs(context.New(), ch, resume)
+	}()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	enc := json.NewEncoder(out)
+	for b := range ch {
+		l := listedBlob{
+			Ref:   b.Ref().String(),
+			Size:  b.Size(),
+			Token: b.Token,
+		}
+		if !filter.match(l.Ref, l.Size) {
+			continue
+		}
+		l.Valid = b.ValidContents()
+		if asJSON {
+			if err := enc.Encode(l); err != nil {
+				return err
+			}
+			continue
+		}
+		status := "valid"
+		if !l.Valid {
+			status = "corrupt"
+		}
+		if _, err := fmt.Fprintf(out, "%s\t%d\t%s\t%s\n", l.Ref, l.Size, l.Token, status); err != nil {
+			return err
+		}
+	}
+	return <-errCh
+}
+
+// catSchema pretty-prints body if it's a schema blob, and copies it
+// unchanged otherwise.
+func catSchema(w io.Writer, br blob.Ref, body io.Reader) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	var pretty bytes.Buffer
+	if _, ok := fsck.ParseSchema(br, bytes.NewReader(data)); ok && json.Indent(&pretty, data, "", "  ") == nil {
+		pretty.WriteByte('\n')
+		data = pretty.Bytes()
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// inspectBlob describes a blob as it is in the blobstore and, if idx
+// isn't nil, as it is in the fsck index.
+func inspectBlob(w io.Writer, fetcher blob.Fetcher, idx *db.DB, br blob.Ref) error {
+	fmt.Fprintf(w, "ref: %s\n", br)
+	body, size, err := fetcher.Fetch(br)
+	if err != nil {
+		fmt.Fprintf(w, "blobstore: %s\n", err)
+	} else {
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+		h := br.Hash()
+		h.Write(data)
+		fmt.Fprintf(w, "size: %d\n", size)
+		fmt.Fprintf(w, "valid: %t\n", br.HashMatches(h))
+		if s, ok := fsck.ParseSchema(br, bytes.NewReader(data)); ok {
+			fmt.Fprintf(w, "camliType: %s\n", s.Type())
+			var pretty bytes.Buffer
+			if err := json.Indent(&pretty, []byte(s.JSON()), "", "  "); err == nil {
+				fmt.Fprintf(w, "schema:\n%s\n", pretty.Bytes())
+			}
+			for _, child := range fsck.Dependencies(s) {
+				status := "found"
+				if cr, ok := blob.Parse(child); !ok {
+					status = "invalid"
+				} else if body, _, err := fetcher.Fetch(cr); err != nil {
+					status = "missing"
+				} else {
+					body.Close()
+				}
+				fmt.Fprintf(w, "child: %s %s\n", child, status)
+			}
+		}
+	}
+	if idx == nil {
+		return nil
+	}
+	locations, err := idx.Locations(br.String())
+	if err != nil {
+		return err
+	}
+	for _, l := range locations {
+		fmt.Fprintf(w, "location: %s\n", l)
+	}
+	if _, ok, err := idx.Lookup(br.String()); err != nil {
+		return err
+	} else if !ok {
+		fmt.Fprintln(w, "index: not found")
+	}
+	missingFrom, err := idx.MissingFrom(br.String())
+	if err != nil {
+		return err
+	}
+	for _, p := range missingFrom {
+		fmt.Fprintf(w, "missing from: %s\n", p)
+	}
+	parents, err := idx.Parents(br.String())
+	if err != nil {
+		return err
+	}
+	for _, p := range parents {
+		fmt.Fprintf(w, "parent: %s\n", p)
+	}
+	return nil
+}
+
+// server is a read-only HTTP view of a blobstore and, optionally,
+// its fsck index.
+type server struct {
+	bs blobserver.Storage
+	db *db.DB
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveHome)
+	mux.HandleFunc("/ref/", s.serveRef)
+	mux.HandleFunc("/api/ref/", s.serveRef)
+	mux.HandleFunc("/blob/", s.serveBlob)
+	mux.HandleFunc("/file/", s.serveFile)
+	return mux
+}
+
+// refInfo is everything shown about a ref.
+type refInfo struct {
+	Ref       string
+	Found     bool
+	Size      uint32 `json:",omitempty"`
+	CamliType string `json:",omitempty"`
+	FileName  string `json:",omitempty"`
+	FileSize  int64  `json:",omitempty"`
+	Schema    string `json:"-"`
+	Entries   []entryInfo
+	Index     *indexInfo `json:",omitempty"`
+}
+
+// entryInfo describes a member of a directory or static-set.
+type entryInfo struct {
+	Ref       string
+	Found     bool
+	Name      string `json:",omitempty"`
+	CamliType string `json:",omitempty"`
+	Size      int64  `json:",omitempty"`
+}
+
+// indexInfo is what the fsck index knows about a ref.
+type indexInfo struct {
+	Found       bool
+	Parents     []string
+	MissingFrom []string
+}
+
+var homeTemplate = template.Must(template.New("home").Parse(`<!DOCTYPE html>
+<title>dp serve</title>
+<form action="/ref/"><input name="ref" size="50" placeholder="sha1-..."> <input type="submit" value="Show"></form>
+`))
+
+var refTemplate = template.Must(template.New("ref").Parse(`<!DOCTYPE html>
+<title>{{.Ref}}</title>
+<p><a href="/">home</a></p>
+<h1>{{.Ref}}</h1>
+{{if .Found}}<p>{{.Size}} bytes{{with .CamliType}}, {{.}}{{end}} &middot; <a href="/blob/{{.Ref}}">raw</a> &middot; <a href="/api/ref/{{.Ref}}">json</a>
+{{if eq .CamliType "file"}} &middot; <a href="/file/{{.Ref}}/{{.FileName}}">download {{.FileName}}</a> ({{.FileSize}} bytes){{end}}</p>
+{{else}}<p>not in blobstore</p>
+{{end}}
+{{with .Entries}}<h2>Entries</h2>
+<table>
+{{range .}}<tr><td><a href="/ref/{{.Ref}}">{{if .Name}}{{.Name}}{{else}}{{.Ref}}{{end}}</a></td><td>{{.CamliType}}</td><td>{{if .Size}}{{.Size}}{{end}}</td><td>{{if not .Found}}missing{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+{{with .Index}}<h2>Index</h2>
+<p>{{if .Found}}indexed{{else}}not indexed{{end}}{{if .MissingFrom}}; missing, referenced by:{{end}}</p>
+{{with .MissingFrom}}<ul>{{range .}}<li><a href="/ref/{{.}}">{{.}}</a>{{end}}</ul>{{end}}
+{{with .Parents}}<p>parents:</p><ul>{{range .}}<li><a href="/ref/{{.}}">{{.}}</a>{{end}}</ul>{{end}}
+{{end}}
+{{with .Schema}}<h2>Schema</h2>
+<pre>{{.}}</pre>
+{{end}}
+`))
+
+func (s *server) serveHome(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	homeTemplate.Execute(w, nil)
+}
+
+// serveRef describes a ref as HTML under /ref/, or as JSON under
+// /api/ref/.
+func (s *server) serveRef(w http.ResponseWriter, r *http.Request) {
+	api := strings.HasPrefix(r.URL.Path, "/api/")
+	ref := path.Base(r.URL.Path)
+	if v := r.FormValue("ref"); v != "" {
+		ref = strings.TrimSpace(v)
+	}
+	br, ok := blob.Parse(ref)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unparseable ref %q", ref), http.StatusBadRequest)
+		return
+	}
+	info, err := s.describe(br)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if api {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+	if err := refTemplate.Execute(w, info); err != nil {
+		log.Print(err)
+	}
+}
+
+func (s *server) describe(br blob.Ref) (*refInfo, error) {
+	info := &refInfo{Ref: br.String()}
+	if s.db != nil {
+		idx := &indexInfo{}
+		var err error
+		if _, idx.Found, err = s.db.Lookup(info.Ref); err != nil {
+			return nil, err
+		}
+		if idx.Parents, err = s.db.Parents(info.Ref); err != nil {
+			return nil, err
+		}
+		if idx.MissingFrom, err = s.db.MissingFrom(info.Ref); err != nil {
+			return nil, err
+		}
+		info.Index = idx
+	}
+	body, size, err := s.bs.Fetch(br)
+	if err != nil {
+		return info, nil
+	}
+	body.Close()
+	info.Found, info.Size = true, size
+	sb, ok := fsck.FetchSchema(s.bs, br)
+	if !ok {
+		return info, nil
+	}
+	info.CamliType = sb.Type()
+	info.FileName = sb.FileName()
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, []byte(sb.JSON()), "", "  ") == nil {
+		info.Schema = pretty.String()
+	}
+	var members []blob.Ref
+	switch sb.Type() {
+	case "file":
+		info.FileSize = sb.PartsSize()
+	case "static-set":
+		members = sb.StaticSetMembers()
+	case "directory":
+		entries, ok := sb.DirectoryEntries()
+		if !ok {
+			break
+		}
+		set, ok := fsck.FetchSchema(s.bs, entries)
+		if !ok {
+			info.Entries = append(info.Entries, entryInfo{Ref: entries.String()})
+			break
+		}
+		members = set.StaticSetMembers()
+	}
+	for _, m := range members {
+		e := entryInfo{Ref: m.String()}
+		if ms, ok := fsck.FetchSchema(s.bs, m); ok {
+			e.Found = true
+			e.Name = ms.FileName()
+			e.CamliType = ms.Type()
+			if e.CamliType == "file" {
+				e.Size = ms.PartsSize()
+			}
+		} else if body, _, err := s.bs.Fetch(m); err == nil {
+			body.Close()
+			e.Found = true
+		}
+		info.Entries = append(info.Entries, e)
+	}
+	return info, nil
+}
+
+// serveBlob serves the raw contents of /blob/<ref>.
+func (s *server) serveBlob(w http.ResponseWriter, r *http.Request) {
+	br, ok := blob.Parse(path.Base(r.URL.Path))
+	if !ok {
+		http.Error(w, "unparseable ref", http.StatusBadRequest)
+		return
+	}
+	body, size, err := s.bs.Fetch(br)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	io.Copy(w, body)
+}
+
+// serveFile serves the contents of the file at /file/<ref>/<name>,
+// supporting Range requests.
+func (s *server) serveFile(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/file/"), "/", 2)
+	br, ok := blob.Parse(parts[0])
+	if !ok {
+		http.Error(w, "unparseable ref", http.StatusBadRequest)
+		return
+	}
+	sb, ok := fsck.FetchSchema(s.bs, br)
+	if !ok || sb.Type() != "file" {
+		http.NotFound(w, r)
+		return
+	}
+	fr, err := sb.NewFileReader(s.bs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer fr.Close()
+	f := fsck.File{ReadSeeker: fr, Blob: sb, Path: sb.FileName()}
+	if len(parts) == 2 && parts[1] != "" {
+		f.Path = parts[1]
+	}
+	http.ServeContent(w, r, f.Path, f.ModTime(), f)
+}
+
+// tarMode converts file permissions to the bits used in tar headers.
+func tarMode(m os.FileMode) int64 {
+	mode := int64(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// readRefs reads a set of refs from the first field of each line of
+// a file, such as the output of "fsck gc-plan".
+func readRefs(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	refs := make(map[string]bool)
+	in := bufio.NewScanner(f)
+	for in.Scan() {
+		fields := strings.Fields(in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if _, ok := blob.Parse(fields[0]); !ok {
+			return nil, fmt.Errorf("%s: unparseable ref %q", path, fields[0])
+		}
+		refs[fields[0]] = true
+	}
+	return refs, in.Err()
+}
+
+// refSet is an order-independent fingerprint of a set of refs.
+type refSet struct {
+	n   int
+	sum [sha1.Size]byte
+}
+
+func (s *refSet) add(ref blob.Ref) {
+	h := sha1.Sum([]byte(ref.String()))
+	for i := range h {
+		s.sum[i] ^= h[i]
+	}
+	s.n++
+}
+
+func (s refSet) String() string {
+	return fmt.Sprintf("%d refs (%x)", s.n, s.sum)
+}
+
+// compactBlobs streams every blob in src and writes those that are
+// valid, not yet written, and kept (if keep is true, those in refs;
+// otherwise those not in refs) to a new diskpacked blobstore in
+// dest. The new blobstore is then streamed back to verify that it
+// contains exactly the blobs that were written.
+func compactBlobs(src blobserver.Storage, dest string, refs map[string]bool, keep bool) error {
+	streamer, ok := src.(blobserver.BlobStreamer)
+	if !ok {
+		return errors.New("source is not a BlobStreamer")
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s: already exists", dest)
+	}
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+	dst, err := diskpacked.New(dest)
+	if err != nil {
+		return err
+	}
+
+	stats := fsck.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
+	ch := make(chan blobserver.BlobAndToken, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- streamer.StreamBlobs(context.New(), ch, "")
+	}()
+	var written refSet
+	// kept refs that were written
+	kept := make(map[string]bool)
+	for b := range ch {
+		ref := b.Ref()
+		if refs[ref.String()] != keep {
+			stats.Add("dropped")
+			continue
+		}
+		if !b.ValidContents() {
+			log.Printf("%s: corrupt at %q", ref, b.Token)
+			stats.Add("corrupt")
+			continue
+		}
+		switch _, err := blobserver.StatBlob(dst, ref); {
+		case err == nil:
+			stats.Add("duplicate")
+			continue
+		case !os.IsNotExist(err):
+			return err
+		}
+		body := b.Open()
+		_, err := blobserver.Receive(dst, ref, body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", ref, err)
+		}
+		written.add(ref)
+		if keep {
+			kept[ref.String()] = true
+		}
+		stats.Add("written")
+	}
+	if err := <-errCh; err != nil {
+		return err
+	}
+	if c, ok := dst.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	if keep {
+		for ref := range refs {
+			if !kept[ref] {
+				log.Printf("%s: kept, but not found valid in source", ref)
+			}
+		}
+	}
+
+	log.Printf("verifying %s", dest)
+	check, err := dir.New(dest)
+	if err != nil {
+		return err
+	}
+	streamer, ok = check.(blobserver.BlobStreamer)
+	if !ok {
+		return errors.New("destination is not a BlobStreamer")
+	}
+	ch = make(chan blobserver.BlobAndToken, 10)
+	go func() {
+		errCh <- streamer.StreamBlobs(context.New(), ch, "")
+	}()
+	var found refSet
+	for b := range ch {
+		if !b.ValidContents() {
+			return fmt.Errorf("%s: corrupt at %q in %s", b.Ref(), b.Token, dest)
+		}
+		found.add(b.Ref())
+	}
+	if err := <-errCh; err != nil {
+		return err
+	}
+	if found != written {
+		return fmt.Errorf("wrote %s, but %s contains %s", written, dest, found)
+	}
+	log.Printf("verified %s", found)
+	return nil
+}
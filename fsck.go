@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -15,11 +22,12 @@ import (
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/blobserver/dir"
 	"camlistore.org/pkg/context"
-	"camlistore.org/pkg/index"
 	"camlistore.org/pkg/magic"
 	"camlistore.org/pkg/schema"
 	"github.com/gonuts/commander"
 
+	humanize "github.com/dustin/go-humanize"
+
 	"github.com/dichro/cameloff/db"
 	fs "github.com/dichro/cameloff/fsck"
 )
@@ -40,22 +48,37 @@ func (b *status) resolve(ref string) {
 }
 
 func main() {
-	var dbDir, blobDir string
+	var dbDir, blobDir, rootsFile string
 
 	scan := &commander.Command{
 		UsageLine: "scan scans a diskpacked blobstore",
 	}
 	restart := scan.Flag.Bool("restart", false, "Restart scan from start, ignoring prior progress")
+	deferMissing := scan.Flag.Bool("defer_missing", false, "Resolve missing blobs in a single pass after the scan, instead of as each blob is found")
+	scanWorkers := scan.Flag.Int("workers", 1, "Number of goroutines parsing blobs")
+	batchBlobs := scan.Flag.Int("batch_blobs", 1000, "Maximum number of blobs written to the index at once")
+	batchBytes := scan.Flag.Uint64("batch_bytes", 16<<20, "Maximum bytes of blobs written to the index at once")
+	incremental := scan.Flag.Bool("incremental", false, "Only rescan pack files that are new or changed since they were last scanned")
+	checksum := scan.Flag.Bool("checksum", false, "Also compare pack file checksums to detect changes")
 	scan.Run = func(*commander.Command, []string) error {
-		scanBlobs(dbDir, blobDir, *restart)
+		if *scanWorkers < 1 {
+			return errors.New("--workers must be at least 1")
+		}
+		if *incremental && *restart {
+			return errors.New("--incremental and --restart are mutually exclusive")
+		}
+		scanBlobs(dbDir, blobDir, *restart, *deferMissing, *incremental, *checksum, *scanWorkers, *batchBlobs, *batchBytes)
 		return nil
 	}
 
 	missing := &commander.Command{
 		UsageLine: "missing prints unresolved references",
-		Run: func(*commander.Command, []string) error {
-			return missingBlobs(dbDir, blobDir)
-		},
+	}
+	format := missing.Flag.String("format", "text", "Output format: text, json or jsonl")
+	cacheSize := missing.Flag.Int("cache_size", 100000, "Number of parent lists and schema blobs to cache")
+	byFile := missing.Flag.Bool("by_file", false, "Report each file with missing contents, instead of each missing blob")
+	missing.Run = func(*commander.Command, []string) error {
+		return missingBlobs(dbDir, blobDir, *format, *cacheSize, *byFile)
 	}
 
 	stats := &commander.Command{
@@ -81,10 +104,85 @@ func main() {
 	}
 	mimeScan.Flag.IntVar(&workers, "workers", 8, "number of i/o goroutines")
 
+	var bare bool
 	filePath := &commander.Command{
 		UsageLine: "filepath prints paths to file blobs",
 		Run: func(cmd *commander.Command, refs []string) error {
-			return filePath(dbDir, blobDir, refs)
+			return filePath(dbDir, blobDir, refs, bare)
+		},
+	}
+	filePath.Flag.BoolVar(&bare, "bare", false, "Leave out the permanodes that own each path, as read by dp tar")
+
+	dups := &commander.Command{
+		UsageLine: "dups lists blobs stored at more than one location",
+		Run: func(*commander.Command, []string) error {
+			return dupBlobs(dbDir)
+		},
+	}
+
+	orphans := &commander.Command{
+		UsageLine: "orphans lists blobs that are not referenced by any other blob",
+		Run: func(*commander.Command, []string) error {
+			return orphanBlobs(dbDir)
+		},
+	}
+
+	gcPlan := &commander.Command{
+		UsageLine: "gc-plan lists blobs unreachable from permanodes and supplied roots",
+		Run: func(cmd *commander.Command, roots []string) error {
+			return gcPlanBlobs(dbDir, rootsFile, roots)
+		},
+	}
+	gcPlan.Flag.StringVar(&rootsFile, "roots", "", "File of additional root refs, one per line")
+
+	corrupt := &commander.Command{
+		UsageLine: "corrupt lists corrupt blobs and the files they damage",
+		Run: func(*commander.Command, []string) error {
+			return corruptBlobs(dbDir, blobDir)
+		},
+	}
+
+	var backupDir string
+	var dryRun bool
+	repair := &commander.Command{
+		UsageLine: "repair copies missing and corrupt blobs from a backup blobstore",
+		Run: func(*commander.Command, []string) error {
+			return repairBlobs(dbDir, blobDir, backupDir, dryRun)
+		},
+	}
+	repair.Flag.StringVar(&backupDir, "backup_dir", "", "Camlistore blob directory to copy blobs from")
+	repair.Flag.BoolVar(&dryRun, "dry_run", false, "Only report which blobs could be recovered")
+
+	var pruneDryRun bool
+	prune := &commander.Command{
+		UsageLine: "prune removes blobs that have vanished from the blobstore from the index",
+		Run: func(*commander.Command, []string) error {
+			return pruneBlobs(dbDir, blobDir, pruneDryRun)
+		},
+	}
+	prune.Flag.BoolVar(&pruneDryRun, "dry_run", false, "Only report which blobs have vanished")
+
+	verify := &commander.Command{
+		UsageLine: "verify re-hashes indexed blobs to detect corruption since they were scanned",
+	}
+	verifyRestart := verify.Flag.Bool("restart", false, "Restart verification from the first blob, ignoring prior progress")
+	sample := verify.Flag.Float64("sample", 1, "Fraction of blobs to verify, chosen at random")
+	packRange := verify.Flag.String("packs", "", "Only verify copies in this pack or range of packs, such as 3 or 3-7")
+	rate := verify.Flag.Int64("rate", 0, "Maximum bytes read per second; unlimited if zero")
+	verify.Run = func(*commander.Command, []string) error {
+		if *sample <= 0 || *sample > 1 {
+			return errors.New("--sample must be more than 0 and at most 1")
+		}
+		if *rate < 0 {
+			return errors.New("--rate must not be negative")
+		}
+		return verifyBlobs(dbDir, blobDir, *verifyRestart, *sample, *packRange, *rate)
+	}
+
+	damage := &commander.Command{
+		UsageLine: "damage prints the ranges of files that are missing or corrupt",
+		Run: func(cmd *commander.Command, refs []string) error {
+			return damagedFiles(dbDir, blobDir, refs)
 		},
 	}
 
@@ -97,6 +195,14 @@ func main() {
 			list,
 			mimeScan,
 			filePath,
+			dups,
+			orphans,
+			gcPlan,
+			corrupt,
+			repair,
+			prune,
+			verify,
+			damage,
 		},
 	}
 
@@ -106,7 +212,7 @@ func main() {
 	}
 
 	// add --blob_dir as appropriate
-	for _, cmd := range []*commander.Command{scan, mimeScan, missing, filePath} {
+	for _, cmd := range []*commander.Command{scan, mimeScan, missing, filePath, corrupt, repair, prune, verify, damage} {
 		cmd.Flag.StringVar(&blobDir, "blob_dir", "", "Camlistore blob directory")
 	}
 
@@ -135,288 +241,373 @@ func listBlobs(dbDir string, args []string) error {
 	return nil
 }
 
-func missingBlobs(dbDir, blobDir string) error {
+func dupBlobs(dbDir string) error {
 	fsck, err := db.NewRO(dbDir)
 	if err != nil {
 		return err
 	}
 	defer fsck.Close()
-	bs, err := dir.New(blobDir)
+	var dups, wasted uint64
+	for dup := range fsck.Dups() {
+		fmt.Printf("%s (%d bytes) wastes %d bytes\n", dup.Ref, dup.Size, dup.Wasted())
+		for _, location := range dup.Locations {
+			fmt.Printf("  %s\n", location)
+		}
+		dups++
+		wasted += dup.Wasted()
+	}
+	fmt.Println("total", dups, "wasted", wasted)
+	return nil
+}
+
+func orphanBlobs(dbDir string) error {
+	fsck, err := db.NewRO(dbDir)
 	if err != nil {
 		return err
 	}
-	// defer s.Close() - where is this??
-	missing := 0
-	// TODO(dichro): cache Parents() call results?
-	for ref := range fsck.Missing() {
-		if body, size, err := bs.Fetch(blob.MustParse(ref)); err == nil {
-			log.Printf("missing ref %q found with size %d", ref, size)
-			body.Close()
-			continue
-		}
-		fmt.Println(ref)
-		missing++
-		nodes, err := fsck.Parents(ref)
-		if err != nil {
-			log.Print(err)
-			continue
+	defer fsck.Close()
+	untyped, err := fsck.Untyped()
+	if err != nil {
+		return err
+	}
+	if untyped > 0 {
+		log.Printf("warning: skipping %d blobs indexed without their types; rescan with --restart to include them", untyped)
+	}
+	counts := make(map[string]int64)
+	sizes := make(map[string]int64)
+	var total, totalSize int64
+	for o := range fsck.Orphans() {
+		t := o.CamliType
+		if t == "" {
+			t = "data"
 		}
-		printHierarchy(fsck, bs, 1, "", nodes)
+		fmt.Printf("%s (%s) %d\n", o.Ref, t, o.Size)
+		counts[t]++
+		sizes[t] += int64(o.Size)
+		total++
+		totalSize += int64(o.Size)
+	}
+	types := []string{}
+	for t := range counts {
+		types = append(types, t)
 	}
-	fmt.Println("total", missing)
+	sort.Strings(types)
+	for _, t := range types {
+		printCount(t, counts[t], sizes[t])
+	}
+	fmt.Println("total", total, "size", totalSize)
 	return nil
 }
 
-func printHierarchy(fsck *db.DB, bs blob.Fetcher, depth int, suffix string, nodes []string) {
-	prefix := ""
-	for i := 0; i < depth; i++ {
-		prefix = prefix + "  "
+func gcPlanBlobs(dbDir, rootsFile string, roots []string) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
 	}
-	for _, node := range nodes {
-		nextSuffix := suffix
-		ref := blob.MustParse(node)
-		camliType := "unknown"
-		if body, _, err := bs.Fetch(ref); err != nil {
-			camliType = fmt.Sprintf("Fetch(): %s", err)
-		} else {
-			if s, ok := parseSchema(ref, body); ok {
-				fileName := s.FileName()
-				switch t := s.Type(); t {
-				case "file":
-					// this blob is a "file" that just happens to contain a
-					// camlistore blob in its contents. This happens because I
-					// may have camput my blobs directory once or twice :P
-					if len(suffix) > 0 {
-						nextSuffix = fmt.Sprintf("%s -> %s", fileName, nextSuffix)
-					} else {
-						nextSuffix = fileName
-					}
-					camliType = fmt.Sprintf("%s: %q", t, nextSuffix)
-				case "directory":
-					nextSuffix = fmt.Sprintf("%s/%s", fileName, suffix)
-					camliType = fmt.Sprintf("%s: %q", t, nextSuffix)
-				default:
-					camliType = t
-				}
+	defer fsck.Close()
+	// an index without types would make every blob unreachable
+	switch untyped, err := fsck.Untyped(); {
+	case err != nil:
+		return err
+	case untyped > 0:
+		return fmt.Errorf("%d blobs were indexed without their types; rebuild the index with fsck scan --restart", untyped)
+	}
+	rootSet := make(map[string]bool)
+	for _, r := range roots {
+		rootSet[r] = true
+	}
+	if rootsFile != "" {
+		f, err := os.Open(rootsFile)
+		if err != nil {
+			return err
+		}
+		in := bufio.NewScanner(f)
+		for in.Scan() {
+			rootSet[strings.TrimSpace(in.Text())] = true
+		}
+		f.Close()
+		if err := in.Err(); err != nil {
+			return err
+		}
+	}
+	if len(rootSet) == 0 {
+		hasRoots := false
+		for _, ct := range []string{"permanode", "claim"} {
+			found, err := fsck.HasType(ct)
+			if err != nil {
+				return err
 			}
-			body.Close()
+			hasRoots = hasRoots || found
 		}
+		if !hasRoots {
+			return errors.New("no permanodes, claims or other roots are indexed")
+		}
+	}
+	l, err := fsck.NewLiveness(rootSet)
+	if err != nil {
+		return err
+	}
 
-		switch next, err := fsck.Parents(node); {
-		case err != nil:
-			fmt.Printf("%s* %s: %s\n", prefix, node, err)
-		case len(next) == 0:
-			fmt.Printf("%s- %s (%s)\n", prefix, node, camliType)
-		default:
-			fmt.Printf("%s+ %s (%s)\n", prefix, node, camliType)
-			printHierarchy(fsck, bs, depth+1, nextSuffix, next)
+	stats := fs.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+	var unreachable, size uint64
+	for b := range fsck.Blobs() {
+		live, err := l.Live(b)
+		if err != nil {
+			return err
+		}
+		if live {
+			stats.Add("live")
+			continue
+		}
+		stats.Add("unreachable")
+		locations, err := fsck.Locations(b.Ref)
+		if err != nil {
+			return err
+		}
+		for _, location := range locations {
+			pack, offset, err := fs.ParseToken(location)
+			if err != nil {
+				log.Printf("%s: unparseable location %q", b.Ref, location)
+				continue
+			}
+			fmt.Printf("%s\t%d\t%s\t%d\n", b.Ref, b.Size, fs.PackName(pack), offset)
+			size += uint64(b.Size)
 		}
+		unreachable++
 	}
+	log.Printf("%d unreachable blobs in %d bytes", unreachable, size)
+	return nil
 }
 
-func statsBlobs(dbDir string) error {
+func corruptBlobs(dbDir, blobDir string) error {
 	fsck, err := db.NewRO(dbDir)
 	if err != nil {
 		return err
 	}
-	s := fsck.Stats()
-	fmt.Println(s)
-	if len(s.CamliTypes) != 0 {
-		fmt.Println("camliTypes:")
-		camliTypes := []string{}
-		for t := range s.CamliTypes {
-			camliTypes = append(camliTypes, t)
-		}
-		sort.Strings(camliTypes)
-		for _, t := range camliTypes {
-			fmt.Printf("\t%q: %d\n", t, s.CamliTypes[t])
-		}
+	defer fsck.Close()
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
 	}
-	if len(s.MIMETypes) != 0 {
-		fmt.Println("MIMETypes:")
-		types := []string{}
-		for t := range s.MIMETypes {
-			types = append(types, t)
+	corrupt := 0
+	for c := range fsck.Corrupt() {
+		intact := ""
+		switch _, ok, err := fsck.Lookup(c.Ref); {
+		case err != nil:
+			return err
+		case ok:
+			intact = "; intact copy found"
 		}
-		sort.Strings(types)
-		for _, t := range types {
-			fmt.Printf("\t%q: %d\n", t, s.MIMETypes[t])
+		fmt.Printf("%s at %q (%d bytes%s)\n", c.Ref, c.Location, c.Size, intact)
+		corrupt++
+		ch := make(chan []string, 10)
+		go func() {
+			fsck.StreamAllParentPaths(c.Ref, ch)
+			close(ch)
+		}()
+		for path := range ch {
+			if len(path) == 0 {
+				continue
+			}
+			pretty, ok, err := prettyPath(fsck, bs, path, false)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			if ok {
+				fmt.Println(" ", pretty)
+			}
 		}
 	}
+	fmt.Println("total", corrupt)
 	return nil
 }
 
-func scanBlobs(dbDir, blobDir string, restart bool) {
-	fsck, err := db.New(dbDir)
+// pruneBlobs checks that every copy of every indexed blob is still at
+// its recorded location, and removes those that aren't from the
+// index. Blobs left without any copy are forgotten entirely.
+func pruneBlobs(dbDir, blobDir string, dryRun bool) error {
+	open := db.New
+	if dryRun {
+		open = db.NewRO
+	}
+	fsck, err := open(dbDir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
-	last := fsck.Last()
-	if last != "" {
-		if restart {
-			fmt.Println("overwriting blob scan resume marker at", last)
-			last = ""
-		} else {
-			fmt.Println("resuming blob scan at", last)
-		}
+	defer fsck.Close()
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
 	}
-
-	blobCh := streamBlobs(blobDir, last)
+	packs := fs.NewPackFiles(blobDir)
+	defer packs.Close()
 
 	stats := fs.NewStats()
 	defer stats.LogEvery(10 * time.Second).Stop()
 	defer log.Print(stats)
-	for b := range blobCh {
-		if !b.ValidContents() {
-			stats.Add("corrupt")
-			continue
-		}
-		ref := b.Ref()
-		body := b.Open()
-		s, ok := parseSchema(ref, body)
-		body.Close()
-		if !ok {
-			stats.Add("data")
-			if err := fsck.Place(ref.String(), b.Token, "", nil); err != nil {
-				log.Fatal(err)
+
+	// locations of copies that have gone, by ref; other blobs may
+	// since have been written at the same locations
+	gone := make(map[string]map[string]bool)
+	vanished := make(map[string]bool)
+	for b := range fsck.Blobs() {
+		if b.Location == "" {
+			// recovered from a backup at an unknown location
+			switch _, err := blobserver.StatBlob(bs, blob.MustParse(b.Ref)); {
+			case err == nil:
+				stats.Add("present")
+			case os.IsNotExist(err):
+				log.Printf("%s: vanished", b.Ref)
+				stats.Add("vanished")
+				vanished[b.Ref] = true
+			default:
+				return err
 			}
 			continue
 		}
-		needs := indexSchemaBlob(fsck, s)
-		t := s.Type()
-		stats.Add(t)
-		if err := fsck.Place(ref.String(), b.Token, t, needs); err != nil {
-			log.Fatal(err)
-		}
-	}
-}
-
-func indexSchemaBlob(fsck *db.DB, s *schema.Blob) (needs []string) {
-	camliType := s.Type()
-	switch camliType {
-	case "static-set":
-		for _, r := range s.StaticSetMembers() {
-			needs = append(needs, r.String())
+		locations, err := fsck.Locations(b.Ref)
+		if err != nil {
+			return err
 		}
-	case "bytes":
-		fallthrough
-	case "file":
-		for i, bp := range s.ByteParts() {
-			ok := false
-			if r := bp.BlobRef; r.Valid() {
-				needs = append(needs, r.String())
-				ok = true
+		present := 0
+		for _, l := range locations {
+			ok, err := packs.Has(b.Ref, b.Size, l)
+			if err != nil {
+				return err
 			}
-			if r := bp.BytesRef; r.Valid() {
-				needs = append(needs, r.String())
-				ok = true
+			if ok {
+				present++
+				continue
 			}
-			if !ok {
-				log.Printf("%s (%s): no valid ref in part %d", s.BlobRef(), camliType, i)
+			log.Printf("%s: gone from %q", b.Ref, l)
+			if gone[b.Ref] == nil {
+				gone[b.Ref] = make(map[string]bool)
 			}
+			gone[b.Ref][l] = true
 		}
-	case "directory":
-		switch r, ok := s.DirectoryEntries(); {
-		case !ok:
-			log.Printf("%s (%s): bad entries", s.BlobRef(), camliType)
-		case !r.Valid():
-			log.Printf("%s (%s): invalid entries", s.BlobRef(), camliType)
+		switch {
+		case present == 0:
+			stats.Add("vanished")
+			vanished[b.Ref] = true
+		case present < len(locations):
+			stats.Add("moved")
 		default:
-			needs = append(needs, r.String())
+			stats.Add("present")
 		}
 	}
-	return
-}
-
-func parseSchema(ref blob.Ref, body io.Reader) (*schema.Blob, bool) {
-	sn := index.NewBlobSniffer(ref)
-	io.Copy(sn, body)
-	sn.Parse()
-	return sn.SchemaBlob()
-}
-
-func streamBlobs(path, resume string) <-chan blobserver.BlobAndToken {
-	s, err := dir.New(path)
+	if dryRun {
+		return nil
+	}
+	stale := func(ref, location string) bool { return gone[ref][location] }
+	if _, err := fsck.DropLocations(stale); err != nil {
+		return err
+	}
+	reconciled, repointed, err := fsck.Reconcile(stale)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	bs, ok := s.(blobserver.BlobStreamer)
-	if !ok {
-		log.Fatalf("%v is not a BlobStreamer", s)
+	for ref := range reconciled {
+		vanished[ref] = true
 	}
-
-	ch := make(chan blobserver.BlobAndToken, 10)
-	go func() {
-		ctx := context.New()
-		if err := bs.StreamBlobs(ctx, ch, resume); err != nil {
-			log.Fatal(err)
-		}
-	}()
-	return ch
+	log.Printf("%d blobs moved to other copies; forgetting %d vanished blobs", repointed, len(vanished))
+	return fsck.Forget(vanished)
 }
 
-func mimeScanBlobs(dbDir, blobDir string, workers int) error {
-	fsck, err := db.NewRO(dbDir)
+// verifyBlobs re-hashes the copies of indexed blobs, reading them
+// directly from their pack files, and records when each blob was
+// verified and which of its copies are now corrupt. Verification
+// resumes after the last blob verified, until a pass completes.
+func verifyBlobs(dbDir, blobDir string, restart bool, sample float64, packRange string, rate int64) error {
+	lo, hi, err := fs.ParsePackRange(packRange)
 	if err != nil {
 		return err
 	}
-	bs, err := dir.New(blobDir)
+	fsck, err := db.New(dbDir)
 	if err != nil {
 		return err
 	}
+	defer fsck.Close()
+	packs := fs.NewPackFiles(blobDir)
+	defer packs.Close()
+	throttle := &fs.Throttle{Rate: float64(rate)}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	stats := fs.NewStats()
 	defer stats.LogEvery(10 * time.Second).Stop()
 	defer log.Print(stats)
-	go func() {
-		for _ = range time.Tick(10 * time.Second) {
-			fmt.Println(time.Now(), stats)
-		}
-	}()
 
-	blobCh := fsck.List("file")
-	var wg sync.WaitGroup
-	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for ref := range blobCh {
-				s, err := schemaFromBlobRef(bs, ref)
-				if err != nil {
-					log.Printf("%s: previously indexed; now missing", ref)
-					stats.Add("badschema")
-					continue
-				}
-				file, err := s.NewFileReader(bs)
-				if err != nil {
-					log.Printf("%s: unreadable: %s", ref, err)
-					stats.Add("unreadable")
-					continue
-				}
-				mime, _ := magic.MIMETypeFromReader(file)
-				file.Close()
-				if mime != "" {
-					if pos := strings.Index(mime, "; charset="); pos >= 0 {
-						mime = mime[:pos]
-					}
-					if err := fsck.PlaceMIME(ref, mime); err != nil {
-						log.Printf("%s: PlaceMIME(): %s", ref, mime)
-						mime = "error"
-					}
-				} else {
-					mime = "unknown"
-				}
-				stats.Add(mime)
+	resume := fsck.VerifyLast()
+	if resume != "" {
+		if restart {
+			fmt.Println("overwriting verification resume marker at", resume)
+			resume = ""
+		} else {
+			fmt.Println("resuming verification after", resume)
+		}
+	}
+	for b := range fsck.BlobsAfter(resume) {
+		if sample < 1 && rnd.Float64() >= sample {
+			continue
+		}
+		br, ok := blob.Parse(b.Ref)
+		if !ok {
+			stats.Add("unparseable")
+			continue
+		}
+		locations, err := fsck.Locations(b.Ref)
+		if err != nil {
+			return err
+		}
+		var corrupt []string
+		checked := 0
+		// indexes built before sizes were recorded have none
+		size := b.Size
+		for _, l := range locations {
+			if n, _, err := fs.ParseToken(l); err != nil || n < lo || n > hi {
+				continue
 			}
-		}()
+			data, ok, err := packs.Read(b.Ref, b.Size, l)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				log.Printf("%s: gone from %q", b.Ref, l)
+				stats.Add("vanished")
+				continue
+			}
+			throttle.Wait(len(data))
+			checked++
+			size = uint32(len(data))
+			h := br.Hash()
+			h.Write(data)
+			if br.HashMatches(h) {
+				stats.Add("valid")
+				continue
+			}
+			log.Printf("%s: corrupt at %q", b.Ref, l)
+			stats.Add("corrupt")
+			corrupt = append(corrupt, l)
+		}
+		if checked == 0 {
+			continue
+		}
+		if err := fsck.PlaceVerified(b.Ref, size, time.Now(), corrupt); err != nil {
+			return err
+		}
 	}
-	wg.Wait()
-	return nil
+	// the pass is complete; start the next from the beginning
+	return fsck.ResetVerify()
 }
 
-func filePath(dbDir, blobDir string, refs []string) error {
-	fsck, err := db.NewRO(dbDir)
+func repairBlobs(dbDir, blobDir, backupDir string, dryRun bool) error {
+	open := db.New
+	if dryRun {
+		open = db.NewRO
+	}
+	fsck, err := open(dbDir)
 	if err != nil {
 		return err
 	}
@@ -425,47 +616,1186 @@ func filePath(dbDir, blobDir string, refs []string) error {
 	if err != nil {
 		return err
 	}
-	for _, r := range refs {
-		ch := make(chan []string, 10)
-		go func() {
-			fsck.StreamAllParentPaths(r, ch)
-			close(ch)
+	backup, err := dir.New(backupDir)
+	if err != nil {
+		return err
+	}
+
+	stats := fs.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
+	// missing refs are streamed once for each parent
+	last := ""
+	for ref := range fsck.Missing() {
+		if ref == last {
+			continue
+		}
+		last = ref
+		br := blob.MustParse(ref)
+		if _, err := blobserver.StatBlob(bs, br); err == nil {
+			log.Printf("%s: missing from index, but present in blobstore", ref)
+			stats.Add("unindexed")
+			continue
+		}
+		if err := repairBlob(fsck, bs, backup, br, false, dryRun, stats); err != nil {
+			return err
+		}
+	}
+	last = ""
+	for c := range fsck.Corrupt() {
+		if c.Ref == last {
+			continue
+		}
+		last = c.Ref
+		switch _, ok, err := fsck.Lookup(c.Ref); {
+		case err != nil:
+			return err
+		case ok:
+			stats.Add("intact")
+			continue
+		}
+		if err := repairBlob(fsck, bs, backup, blob.MustParse(c.Ref), true, dryRun, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairBlob copies a blob from backup to bs, replacing any corrupt
+// copy already in bs, and indexes it. Blobs that can't be recovered
+// are logged.
+func repairBlob(fsck *db.DB, bs, backup blobserver.Storage, br blob.Ref, corrupt, dryRun bool, stats *fs.Stats) error {
+	body, _, err := backup.Fetch(br)
+	if err != nil {
+		log.Printf("%s: unavailable from backup: %s", br, err)
+		stats.Add("unavailable")
+		return nil
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		log.Printf("%s: unreadable from backup: %s", br, err)
+		stats.Add("unavailable")
+		return nil
+	}
+	h := br.Hash()
+	h.Write(data)
+	if !br.HashMatches(h) {
+		log.Printf("%s: corrupt in backup", br)
+		stats.Add("corrupt")
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("%s: recoverable (%d bytes)\n", br, len(data))
+		stats.Add("recoverable")
+		return nil
+	}
+
+	// the blobstore only holds one copy of a ref, so the corrupt
+	// copy has to go before the replacement is written. Its
+	// contents are kept, since they may be partly salvageable, and
+	// are put back if the replacement can't be written.
+	var damaged []byte
+	if corrupt {
+		if body, _, err := bs.Fetch(br); err == nil {
+			damaged, _ = ioutil.ReadAll(body)
+			body.Close()
+		}
+		if err := bs.RemoveBlobs([]blob.Ref{br}); err != nil {
+			return fmt.Errorf("%s: removing corrupt copy: %s", br, err)
+		}
+	}
+	if _, err := blobserver.Receive(bs, br, bytes.NewReader(data)); err != nil {
+		if damaged != nil {
+			// not through blobserver.Receive, which would
+			// refuse them
+			if _, rerr := bs.ReceiveBlob(br, bytes.NewReader(damaged)); rerr != nil {
+				return fmt.Errorf("%s: %s; restoring corrupt copy: %s", br, err, rerr)
+			}
+		}
+		return fmt.Errorf("%s: %s", br, err)
+	}
+	if corrupt {
+		if err := fsck.ClearCorrupt(br.String()); err != nil {
+			return err
+		}
+	}
+	ct := ""
+	var needs []string
+	if s, ok := fs.ParseSchema(br, bytes.NewReader(data)); ok {
+		ct = s.Type()
+		needs = fs.Dependencies(s)
+		if c, ok := claimFromSchema(s); ok {
+			if err := fsck.PlaceClaim(c); err != nil {
+				return err
+			}
+		}
+		if key, ok := fs.Signer(s); ok && (ct == "permanode" || ct == "claim") {
+			if err := fsck.PlaceSigner(key.String(), br.String()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fsck.PlaceRecovered(br.String(), ct, uint32(len(data)), needs); err != nil {
+		return err
+	}
+	fmt.Printf("%s: recovered (%d bytes)\n", br, len(data))
+	stats.Add("recovered")
+	return nil
+}
+
+func missingBlobs(dbDir, blobDir, format string, cacheSize int, byFile bool) error {
+	var out func(interface{})
+	// json streams a single array
+	sep := "["
+	switch format {
+	case "text":
+		out = func(v interface{}) {
+			switch v := v.(type) {
+			case missingBlob:
+				fmt.Println(v.Ref)
+				if v.Error != "" {
+					log.Print(v.Error)
+					return
+				}
+				printHierarchy(1, v.Parents)
+			case *damagedFile:
+				v.print()
+			}
+		}
+	case "json":
+		out = func(v interface{}) {
+			fmt.Print(sep)
+			sep = ",\n"
+			printJSON(v)
+		}
+	case "jsonl":
+		out = func(v interface{}) {
+			printJSON(v)
+			fmt.Println()
+		}
+	default:
+		return fmt.Errorf("unknown format %q, use \"text\", \"json\" or \"jsonl\"", format)
+	}
+
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
+	}
+	// defer s.Close() - where is this??
+	if format == "json" {
+		// only once there's something to report
+		defer func() {
+			if sep == "[" {
+				fmt.Print(sep)
+			}
+			fmt.Println("]")
 		}()
-		// TODO(dichro): print something if there's no paths
-	PATH:
-		for path := range ch {
-			pretty := make([]string, 0, len(path))
-			foundFile := false
-			for i := range path {
-				p := path[len(path)-i-1]
-				s, err := schemaFromBlobRef(bs, p)
-				if err != nil {
+	}
+	h := &hierarchy{
+		fsck:      fsck,
+		bs:        bs,
+		parents:   fs.NewCache(cacheSize),
+		summaries: fs.NewCache(cacheSize),
+	}
+	files := make(map[string]*damagedFile)
+	missing := 0
+	// refs are streamed once for each parent; plain text output
+	// has always listed them that way.
+	dedupe := format != "text" || byFile
+	last := ""
+	for ref := range fsck.Missing() {
+		if dedupe && ref == last {
+			continue
+		}
+		last = ref
+		if body, size, err := bs.Fetch(blob.MustParse(ref)); err == nil {
+			log.Printf("missing ref %q found with size %d", ref, size)
+			body.Close()
+			continue
+		}
+		missing++
+		m := missingBlob{Ref: ref}
+		if parents, err := h.Parents(ref); err != nil {
+			m.Error = err.Error()
+		} else {
+			m.Parents = h.build("", parents)
+			m.Paths = topPaths(m.Parents, nil)
+		}
+		if !byFile {
+			out(m)
+			continue
+		}
+		if m.Error != "" {
+			log.Printf("%s: %s", ref, m.Error)
+			continue
+		}
+		nodes := containingFiles(m.Parents, nil)
+		if len(nodes) == 0 {
+			log.Printf("%s: not within any file", ref)
+		}
+		for _, n := range nodes {
+			f, ok := files[n.Ref]
+			if !ok {
+				f = &damagedFile{
+					Ref:      n.Ref,
+					FileName: n.FileName,
+					Paths:    topPaths(n.Parents, nil),
+				}
+				if len(f.Paths) == 0 {
+					f.Paths = []string{n.Path}
+				}
+				files[n.Ref] = f
+			}
+			f.addMissing(ref)
+		}
+	}
+	if byFile {
+		refs := make([]string, 0, len(files))
+		for ref := range files {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		for _, ref := range refs {
+			f := files[ref]
+			f.assess(bs)
+			out(f)
+		}
+	}
+	if format == "text" {
+		fmt.Println("total", missing)
+	} else {
+		log.Print("total ", missing)
+	}
+	log.Print("parents cache: ", h.parents)
+	log.Print("schema cache: ", h.summaries)
+	return nil
+}
+
+// damagedFile is a file with missing contents.
+type damagedFile struct {
+	Ref      string   `json:"ref"`
+	FileName string   `json:"fileName"`
+	Paths    []string `json:"paths,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Size     int64    `json:"size"`
+	// missing blobs within the file
+	Missing      []string   `json:"missing"`
+	MissingBytes int64      `json:"missingBytes"`
+	Ranges       []fs.Range `json:"ranges,omitempty"`
+}
+
+func (f *damagedFile) addMissing(ref string) {
+	for _, r := range f.Missing {
+		if r == ref {
+			return
+		}
+	}
+	f.Missing = append(f.Missing, ref)
+}
+
+// assess determines the size of the file and which of its contents
+// are missing.
+func (f *damagedFile) assess(bs blob.Fetcher) {
+	s, err := schemaFromBlobRef(bs, f.Ref)
+	if err != nil {
+		f.Error = err.Error()
+		return
+	}
+	f.Size = s.PartsSize()
+	missing := make(map[string]bool)
+	for _, r := range f.Missing {
+		missing[r] = true
+	}
+	f.Ranges = fs.Damage(bs, s, func(r blob.Ref) bool {
+		return missing[r.String()]
+	})
+	for _, r := range f.Ranges {
+		f.MissingBytes += r.End - r.Start
+	}
+}
+
+func (f *damagedFile) print() {
+	fmt.Printf("%s (file: %q) %d bytes, %d missing blobs, %d bytes missing\n",
+		f.Ref, f.FileName, f.Size, len(f.Missing), f.MissingBytes)
+	if f.Error != "" {
+		fmt.Printf("  * %s\n", f.Error)
+	}
+	for _, p := range f.Paths {
+		fmt.Printf("  path: %s\n", p)
+	}
+	if len(f.Ranges) > 0 {
+		ranges := make([]string, len(f.Ranges))
+		for i, r := range f.Ranges {
+			ranges[i] = r.String()
+		}
+		fmt.Printf("  missing: %s\n", strings.Join(ranges, " "))
+	}
+}
+
+// containingFiles appends the first "file" found on the way up each
+// hierarchy to files.
+func containingFiles(nodes []*node, files []*node) []*node {
+	for _, n := range nodes {
+		if n.CamliType == "file" {
+			files = append(files, n)
+		} else {
+			files = containingFiles(n.Parents, files)
+		}
+	}
+	return files
+}
+
+// missingBlob is a missing blob and the hierarchy of blobs that
+// refer to it.
+type missingBlob struct {
+	Ref     string  `json:"ref"`
+	Error   string  `json:"error,omitempty"`
+	Parents []*node `json:"parents,omitempty"`
+	// paths reconstructed from the top of each hierarchy
+	Paths []string `json:"paths,omitempty"`
+}
+
+// node is a blob in the hierarchy of parents of a missing blob.
+type node struct {
+	Ref       string `json:"ref"`
+	CamliType string `json:"camliType,omitempty"`
+	FileName  string `json:"fileName,omitempty"`
+	// path to the missing blob, as reconstructed so far
+	Path         string  `json:"path,omitempty"`
+	Title        string  `json:"title,omitempty"`
+	FetchError   string  `json:"fetchError,omitempty"`
+	ParentsError string  `json:"parentsError,omitempty"`
+	Parents      []*node `json:"parents,omitempty"`
+}
+
+func (n *node) String() string {
+	switch n.CamliType {
+	case "":
+		if n.FetchError != "" {
+			return fmt.Sprintf("Fetch(): %s", n.FetchError)
+		}
+		return "unknown"
+	case "file", "directory":
+		return fmt.Sprintf("%s: %q", n.CamliType, n.Path)
+	case "permanode":
+		return fmt.Sprintf("%s: %q", n.CamliType, n.Title)
+	default:
+		return n.CamliType
+	}
+}
+
+// hierarchy builds the hierarchies of parents of missing blobs,
+// caching the parents and schema blobs that they share.
+type hierarchy struct {
+	fsck               *db.DB
+	bs                 blob.Fetcher
+	parents, summaries *fs.Cache
+}
+
+// summary is the part of a blob needed to describe it in a hierarchy.
+type summary struct {
+	camliType, fileName, title, fetchError string
+}
+
+func (h *hierarchy) Parents(ref string) ([]string, error) {
+	if parents, ok := h.parents.Get(ref); ok {
+		return parents.([]string), nil
+	}
+	parents, err := h.fsck.Parents(ref)
+	if err == nil {
+		h.parents.Add(ref, parents)
+	}
+	return parents, err
+}
+
+func (h *hierarchy) summarize(r string) summary {
+	if s, ok := h.summaries.Get(r); ok {
+		return s.(summary)
+	}
+	var sum summary
+	ref := blob.MustParse(r)
+	if body, _, err := h.bs.Fetch(ref); err != nil {
+		sum.fetchError = err.Error()
+	} else {
+		if s, ok := fs.ParseSchema(ref, body); ok {
+			sum.camliType = s.Type()
+			sum.fileName = s.FileName()
+			if sum.camliType == "permanode" {
+				sum.title = permanodeTitle(h.fsck, r)
+			}
+		}
+		body.Close()
+	}
+	h.summaries.Add(r, sum)
+	return sum
+}
+
+func (h *hierarchy) build(suffix string, refs []string) []*node {
+	nodes := make([]*node, 0, len(refs))
+	for _, r := range refs {
+		sum := h.summarize(r)
+		n := &node{
+			Ref:        r,
+			CamliType:  sum.camliType,
+			FileName:   sum.fileName,
+			Path:       suffix,
+			Title:      sum.title,
+			FetchError: sum.fetchError,
+		}
+		switch n.CamliType {
+		case "file":
+			// this blob is a "file" that just happens to contain a
+			// camlistore blob in its contents. This happens because I
+			// may have camput my blobs directory once or twice :P
+			if len(suffix) > 0 {
+				n.Path = fmt.Sprintf("%s -> %s", n.FileName, suffix)
+			} else {
+				n.Path = n.FileName
+			}
+		case "directory":
+			n.Path = fmt.Sprintf("%s/%s", n.FileName, suffix)
+		}
+		if parents, err := h.Parents(r); err != nil {
+			n.ParentsError = err.Error()
+		} else {
+			n.Parents = h.build(n.Path, parents)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func printHierarchy(depth int, nodes []*node) {
+	prefix := ""
+	for i := 0; i < depth; i++ {
+		prefix = prefix + "  "
+	}
+	for _, n := range nodes {
+		switch {
+		case n.ParentsError != "":
+			fmt.Printf("%s* %s: %s\n", prefix, n.Ref, n.ParentsError)
+		case len(n.Parents) == 0:
+			fmt.Printf("%s- %s (%s)\n", prefix, n.Ref, n)
+		default:
+			fmt.Printf("%s+ %s (%s)\n", prefix, n.Ref, n)
+			printHierarchy(depth+1, n.Parents)
+		}
+	}
+}
+
+// topPaths appends the distinct paths reconstructed at the top of
+// each hierarchy to paths.
+func topPaths(nodes []*node, paths []string) []string {
+NODE:
+	for _, n := range nodes {
+		if len(n.Parents) > 0 {
+			paths = topPaths(n.Parents, paths)
+			continue
+		}
+		if n.Path == "" {
+			continue
+		}
+		for _, p := range paths {
+			if p == n.Path {
+				continue NODE
+			}
+		}
+		paths = append(paths, n.Path)
+	}
+	return paths
+}
+
+func printJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(b)
+}
+
+// permanodeTitle returns the latest title of a permanode, or a
+// description of why it couldn't be found.
+func permanodeTitle(fsck *db.DB, ref string) string {
+	title, err := fsck.Attribute(ref, "title")
+	if err != nil {
+		return fmt.Sprintf("Attribute(): %s", err)
+	}
+	return title
+}
+
+func statsBlobs(dbDir string) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	s := fsck.Stats()
+	fmt.Println(s)
+	if len(s.CamliTypes) != 0 {
+		fmt.Println("camliTypes:")
+		camliTypes := []string{}
+		// whatever isn't a schema blob is data
+		data, dataBytes := int64(s.Blobs), int64(s.Bytes)
+		for t := range s.CamliTypes {
+			camliTypes = append(camliTypes, t)
+			data -= s.CamliTypes[t]
+			dataBytes -= s.CamliTypeBytes[t]
+		}
+		sort.Strings(camliTypes)
+		for _, t := range camliTypes {
+			printCount(t, s.CamliTypes[t], s.CamliTypeBytes[t])
+		}
+		printCount("data", data, dataBytes)
+	}
+	if len(s.MIMETypes) != 0 {
+		fmt.Println("MIMETypes:")
+		types := []string{}
+		for t := range s.MIMETypes {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			printCount(t, s.MIMETypes[t], s.MIMETypeBytes[t])
+		}
+	}
+	if s.Bytes != 0 {
+		fmt.Println("sizes:")
+		for i, n := range s.Sizes {
+			if n == 0 {
+				continue
+			}
+			lower := uint64(0)
+			if i > 0 {
+				lower = 1 << uint(i-1)
+			}
+			fmt.Printf("\t>= %s: %d\n", humanize.IBytes(lower), n)
+		}
+	}
+	return nil
+}
+
+func printCount(t string, count, bytes int64) {
+	fmt.Printf("\t%q: %d (%s)\n", t, count, humanize.IBytes(uint64(bytes)))
+}
+
+func scanBlobs(dbDir, blobDir string, restart, deferMissing, incremental, checksum bool, workers, batchBlobs int, batchBytes uint64) {
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sc := &scanner{
+		fsck:     fsck,
+		blobDir:  blobDir,
+		workers:  workers,
+		checksum: checksum,
+		placer:   fsck.NewPlacer(batchBlobs, batchBytes, deferMissing),
+		stats:    fs.NewStats(),
+	}
+	defer sc.stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(sc.stats)
+	throughput := time.NewTicker(10 * time.Second)
+	defer throughput.Stop()
+	go func() {
+		for _ = range throughput.C {
+			log.Print(sc.placer)
+		}
+	}()
+
+	if incremental {
+		err = sc.incremental()
+	} else {
+		last := fsck.Last()
+		if last != "" {
+			if restart {
+				fmt.Println("overwriting blob scan resume marker at", last)
+				last = ""
+			} else {
+				fmt.Println("resuming blob scan at", last)
+			}
+		}
+		err = sc.scan(streamBlobs(blobDir, last), true)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Print(sc.placer)
+	if deferMissing {
+		log.Print("resolving missing blobs")
+		added, removed, err := fsck.ResolveMissing()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%d missing entries added, %d removed", added, removed)
+	}
+}
+
+// scanner places the blobs streamed from a blobstore in the index.
+type scanner struct {
+	fsck     *db.DB
+	blobDir  string
+	workers  int
+	checksum bool
+	placer   *db.Placer
+	stats    *fs.Stats
+}
+
+// scan places every blob in blobCh. If recordPacks is set, the state
+// of each pack file is recorded once all of its blobs are placed.
+func (sc *scanner) scan(blobCh <-chan blobserver.BlobAndToken, recordPacks bool) error {
+	if sc.workers < 1 {
+		// no blob would ever be parsed
+		return fmt.Errorf("%d workers, need at least 1", sc.workers)
+	}
+	// blobs are numbered in stream order and parsed concurrently,
+	// but committed strictly in order, so the resume marker never
+	// passes a blob that hasn't been committed. window bounds the
+	// number of blobs parsed ahead of the next commit.
+	window := make(chan struct{}, 16*sc.workers)
+	in := make(chan *scannedBlob)
+	go func() {
+		seq := 0
+		for b := range blobCh {
+			window <- struct{}{}
+			in <- &scannedBlob{seq: seq, BlobAndToken: b}
+			seq++
+		}
+		close(in)
+	}()
+	parsed := make(chan *scannedBlob, sc.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < sc.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sb := range in {
+				sb.parse()
+				parsed <- sb
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(parsed)
+	}()
+
+	// the state of a pack is taken when its first blob is placed,
+	// so that anything appended later is picked up by the next
+	// incremental scan.
+	curPack := -1
+	var curState db.PackState
+	recordPack := func() {
+		if recordPacks && curPack >= 0 {
+			sc.placer.PlacePack(curPack, curState)
+		}
+	}
+
+	pending := make(map[int]*scannedBlob)
+	next := 0
+	for sb := range parsed {
+		pending[sb.seq] = sb
+		for {
+			sb, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-window
+			if n, _, err := fs.ParseToken(sb.Token); err == nil && n != curPack {
+				recordPack()
+				curPack = n
+				if curState, err = packState(sc.blobDir, n, sc.checksum); err != nil {
 					return err
 				}
-				str := fmt.Sprintf("(%s:%s)->", s.Type(), p)
-				switch s.Type() {
-				case "directory":
-					str = s.FileName() + "/"
-				case "file":
-					if foundFile {
-						// we already found a "file" that contains the
-						// target blob. If we're seeing another "file" on
-						// the way up, then that "file" must actually
-						// contain a schema blob that ultimately references
-						// our target blob, which is not what we're looking
-						// for.
-						continue PATH
-					}
-					foundFile = true
-					str = s.FileName()
-				case "static-set":
+			}
+			if err := sc.place(sb); err != nil {
+				return err
+			}
+		}
+	}
+	recordPack()
+	return sc.placer.Flush()
+}
+
+func (sc *scanner) place(sb *scannedBlob) error {
+	ref := sb.Ref().String()
+	switch {
+	case sb.corrupt:
+		sc.stats.Add("corrupt")
+		return sc.placer.PlaceCorrupt(ref, sb.Token, sb.Size())
+	case !sb.schema:
+		sc.stats.Add("data")
+		return sc.placer.Place(ref, sb.Token, "", sb.Size(), nil)
+	}
+	if sb.claim != nil {
+		if err := sc.placer.PlaceClaim(*sb.claim); err != nil {
+			return err
+		}
+	}
+	if sb.signer != "" {
+		sc.placer.PlaceSigner(sb.signer, ref)
+	}
+	sc.stats.Add(sb.camliType)
+	return sc.placer.Place(ref, sb.Token, sb.camliType, sb.Size(), sb.needs)
+}
+
+// incremental rescans only the pack files that are new or have
+// changed since they were last scanned, and forgets blobs that have
+// vanished from rewritten or deleted packs. Pack states are only
+// recorded once everything is reconciled, so an interrupted
+// incremental scan starts over.
+func (sc *scanner) incremental() error {
+	recorded, err := sc.fsck.Packs()
+	if err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(sc.blobDir, "pack-*.blobs"))
+	if err != nil {
+		return err
+	}
+	current := make(map[int]db.PackState)
+	var rescan []int
+	for _, name := range names {
+		var n int
+		if _, err := fmt.Sscanf(filepath.Base(name), "pack-%d.blobs", &n); err != nil {
+			continue
+		}
+		if current[n], err = packState(sc.blobDir, n, sc.checksum); err != nil {
+			return err
+		}
+		if old, ok := recorded[n]; !ok || !old.Equal(current[n]) {
+			rescan = append(rescan, n)
+		}
+	}
+	changed := make(map[int]bool)
+	for _, n := range rescan {
+		changed[n] = true
+	}
+	var deleted []int
+	for n := range recorded {
+		if _, ok := current[n]; !ok {
+			deleted = append(deleted, n)
+			changed[n] = true
+		}
+	}
+	if len(changed) == 0 {
+		log.Print("no packs have changed")
+		return nil
+	}
+	sort.Ints(rescan)
+	log.Printf("rescanning %d packs, %d deleted", len(rescan), len(deleted))
+
+	stale := func(_, location string) bool {
+		n, _, err := fs.ParseToken(location)
+		return err == nil && changed[n]
+	}
+	dropped, err := sc.fsck.DropLocations(stale)
+	if err != nil {
+		return err
+	}
+	log.Printf("dropped %d copies in changed packs", dropped)
+
+	streamer, err := blobStreamer(sc.blobDir)
+	if err != nil {
+		return err
+	}
+	// the resume marker belongs to a full scan
+	sc.placer.SkipResume()
+	for _, n := range rescan {
+		log.Printf("scanning %s", fs.PackName(n))
+		if err := sc.scan(streamPack(streamer, n), false); err != nil {
+			return err
+		}
+	}
+
+	vanished, repointed, err := sc.fsck.Reconcile(stale)
+	if err != nil {
+		return err
+	}
+	log.Printf("%d blobs moved to other copies, %d vanished", repointed, len(vanished))
+	if err := sc.fsck.Forget(vanished); err != nil {
+		return err
+	}
+	for _, n := range rescan {
+		if err := sc.fsck.PlacePack(n, current[n]); err != nil {
+			return err
+		}
+	}
+	for _, n := range deleted {
+		if err := sc.fsck.ForgetPack(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packState describes pack file n as it is now, optionally with a
+// checksum of its contents.
+func packState(blobDir string, n int, checksum bool) (s db.PackState, err error) {
+	path := filepath.Join(blobDir, fs.PackName(n))
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	s.Size, s.ModTime = fi.Size(), fi.ModTime()
+	if !checksum {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err = io.CopyN(h, f, s.Size); err != nil {
+		return
+	}
+	s.Checksum = fmt.Sprintf("sha1-%x", h.Sum(nil))
+	return
+}
+
+// scannedBlob is a blob from the blobstore and what parsing it
+// revealed.
+type scannedBlob struct {
+	seq int
+	blobserver.BlobAndToken
+	corrupt   bool
+	schema    bool
+	camliType string
+	needs     []string
+	claim     *db.Claim
+	signer    string
+}
+
+func (sb *scannedBlob) parse() {
+	if !sb.ValidContents() {
+		sb.corrupt = true
+		return
+	}
+	body := sb.Open()
+	s, ok := fs.ParseSchema(sb.Ref(), body)
+	body.Close()
+	if !ok {
+		return
+	}
+	sb.schema = true
+	sb.camliType = s.Type()
+	sb.needs = fs.Dependencies(s)
+	if c, ok := claimFromSchema(s); ok {
+		sb.claim = &c
+	}
+	if sb.camliType == "permanode" || sb.camliType == "claim" {
+		if key, ok := fs.Signer(s); ok {
+			sb.signer = key.String()
+		}
+	}
+}
+
+// claimFromSchema extracts the permanode mutation described by a
+// claim blob.
+func claimFromSchema(s *schema.Blob) (c db.Claim, ok bool) {
+	if s.Type() != "claim" {
+		return
+	}
+	cl, ok := s.AsClaim()
+	if !ok {
+		log.Printf("%s (claim): unparseable claim", s.BlobRef())
+		return
+	}
+	pn := cl.ModifiedPermanode()
+	if !pn.Valid() {
+		// not all claims modify permanodes
+		return c, false
+	}
+	date, err := s.ClaimDate()
+	if err != nil {
+		log.Printf("%s (claim): %s", s.BlobRef(), err)
+		return c, false
+	}
+	return db.Claim{
+		Ref:       s.BlobRef().String(),
+		Permanode: pn.String(),
+		Date:      date,
+		Type:      cl.ClaimType(),
+		Attribute: cl.Attribute(),
+		Value:     cl.Value(),
+	}, true
+}
+
+func streamBlobs(path, resume string) <-chan blobserver.BlobAndToken {
+	bs, err := blobStreamer(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ch := make(chan blobserver.BlobAndToken, 10)
+	go func() {
+		ctx := context.New()
+		if err := bs.StreamBlobs(ctx, ch, resume); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return ch
+}
+
+func blobStreamer(path string) (blobserver.BlobStreamer, error) {
+	s, err := dir.New(path)
+	if err != nil {
+		return nil, err
+	}
+	bs, ok := s.(blobserver.BlobStreamer)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a BlobStreamer", s)
+	}
+	return bs, nil
+}
+
+// streamPack streams the blobs in a single pack file, stopping the
+// stream once it moves on to the next pack.
+func streamPack(bs blobserver.BlobStreamer, n int) <-chan blobserver.BlobAndToken {
+	in := make(chan blobserver.BlobAndToken, 10)
+	out := make(chan blobserver.BlobAndToken, 10)
+	ctx := context.New()
+	done := make(chan struct{})
+	go func() {
+		if err := bs.StreamBlobs(ctx, in, fs.Token(n, 0)); err != nil {
+			select {
+			case <-done:
+				// canceled once past the pack
+			default:
+				log.Fatal(err)
+			}
+		}
+	}()
+	go func() {
+		defer close(out)
+		for b := range in {
+			if p, _, err := fs.ParseToken(b.Token); err != nil || p != n {
+				close(done)
+				ctx.Cancel()
+				break
+			}
+			out <- b
+		}
+		for _ = range in {
+		}
+	}()
+	return out
+}
+
+func mimeScanBlobs(dbDir, blobDir string, workers int) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
+	}
+
+	stats := fs.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+	go func() {
+		for _ = range time.Tick(10 * time.Second) {
+			fmt.Println(time.Now(), stats)
+		}
+	}()
+
+	blobCh := fsck.List("file")
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range blobCh {
+				s, err := schemaFromBlobRef(bs, ref)
+				if err != nil {
+					log.Printf("%s: previously indexed; now missing", ref)
+					stats.Add("badschema")
 					continue
-				case "bytes":
+				}
+				file, err := s.NewFileReader(bs)
+				if err != nil {
+					log.Printf("%s: unreadable: %s", ref, err)
+					stats.Add("unreadable")
 					continue
 				}
-				pretty = append(pretty, str)
+				mime, _ := magic.MIMETypeFromReader(file)
+				file.Close()
+				if mime != "" {
+					if pos := strings.Index(mime, "; charset="); pos >= 0 {
+						mime = mime[:pos]
+					}
+					if err := fsck.PlaceMIME(ref, mime, s.PartsSize()); err != nil {
+						log.Printf("%s: PlaceMIME(): %s", ref, mime)
+						mime = "error"
+					}
+				} else {
+					mime = "unknown"
+				}
+				stats.Add(mime)
 			}
-			fmt.Println(r, strings.Join(pretty, ""))
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func filePath(dbDir, blobDir string, refs []string, bare bool) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if bare {
+			// bare paths end in the ref's own name, so that dp tar
+			// can place it, which only makes sense for files and
+			// directories
+			s, err := schemaFromBlobRef(bs, r)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			if t := s.Type(); t != "file" && t != "directory" {
+				log.Printf("%s: not a file or directory (%s)", r, t)
+				continue
+			}
+		}
+		ch := make(chan []string, 10)
+		go func() {
+			fsck.StreamAllParentPaths(r, ch)
+			close(ch)
+		}()
+		printed := false
+		// TODO(dichro): print something if there's no paths
+		for path := range ch {
+			if bare {
+				if printed {
+					// dp tar takes one path per ref
+					continue
+				}
+				path = append([]string{r}, path...)
+			}
+			pretty, ok, err := prettyPath(fsck, bs, path, bare)
+			if err != nil {
+				return err
+			}
+			if ok {
+				fmt.Println(r, pretty)
+				printed = true
+			}
+		}
+	}
+	return nil
+}
+
+// prettyPath renders a path of parents, as streamed by
+// StreamAllParentPaths, as a file path. Paths that don't lead to the
+// target through the contents of a single file are skipped by
+// returning false. Bare paths leave out permanodes.
+func prettyPath(fsck *db.DB, bs blob.Fetcher, path []string, bare bool) (string, bool, error) {
+	pretty := make([]string, 0, len(path))
+	foundFile := false
+	for i := range path {
+		p := path[len(path)-i-1]
+		s, err := schemaFromBlobRef(bs, p)
+		if err != nil {
+			return "", false, err
+		}
+		str := fmt.Sprintf("(%s:%s)->", s.Type(), p)
+		switch s.Type() {
+		case "directory":
+			str = s.FileName() + "/"
+		case "file":
+			if foundFile {
+				// we already found a "file" that contains the
+				// target blob. If we're seeing another "file" on
+				// the way up, then that "file" must actually
+				// contain a schema blob that ultimately references
+				// our target blob, which is not what we're looking
+				// for.
+				return "", false, nil
+			}
+			foundFile = true
+			str = s.FileName()
+		case "permanode":
+			if bare {
+				continue
+			}
+			str = fmt.Sprintf("[%s %q]/", p, permanodeTitle(fsck, p))
+		case "static-set":
+			continue
+		case "bytes":
+			continue
+		}
+		pretty = append(pretty, str)
+	}
+	return strings.Join(pretty, ""), true, nil
+}
+
+// damagedFiles prints the damaged ranges of each file. Blobs are
+// damaged if they haven't been found by a scan or, with no index,
+// if they're absent from the blobstore.
+func damagedFiles(dbDir, blobDir string, refs []string) error {
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
+	}
+	damaged := func(r blob.Ref) bool {
+		_, err := blobserver.StatBlob(bs, r)
+		return err != nil
+	}
+	if dbDir != "" {
+		fsck, err := db.NewRO(dbDir)
+		if err != nil {
+			return err
+		}
+		defer fsck.Close()
+		damaged = func(r blob.Ref) bool {
+			_, ok, err := fsck.Lookup(r.String())
+			if err != nil {
+				log.Printf("%s: %s", r, err)
+			}
+			return !ok
+		}
+	}
+	for _, ref := range refs {
+		s, err := schemaFromBlobRef(bs, ref)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if t := s.Type(); t != "file" && t != "bytes" {
+			log.Printf("%s: not a file (%s)", ref, t)
+			continue
+		}
+		ranges := fs.Damage(bs, s, damaged)
+		var lost int64
+		for _, r := range ranges {
+			lost += r.End - r.Start
+		}
+		size := s.PartsSize()
+		percent := 0.0
+		if size > 0 {
+			percent = float64(100*lost) / float64(size)
+		}
+		fmt.Printf("%s (%s: %q) %d bytes, %d bytes damaged (%.1f%%)\n",
+			ref, s.Type(), s.FileName(), size, lost, percent)
+		for _, r := range ranges {
+			fmt.Printf("  %s\n", r)
 		}
 	}
 	return nil
@@ -474,14 +1804,14 @@ func filePath(dbDir, blobDir string, refs []string) error {
 func schemaFromBlobRef(bs blob.Fetcher, ref string) (*schema.Blob, error) {
 	br, ok := blob.Parse(ref)
 	if !ok {
-		return nil, fmt.Errorf("%q: unparseable blob ref")
+		return nil, fmt.Errorf("%q: unparseable blob ref", ref)
 	}
 	body, _, err := bs.Fetch(br)
 	if err != nil {
-		// TODO(dichro): delete this from index?
+		// fsck prune removes these from the index
 		return nil, fmt.Errorf("%s: previously indexed; now missing", br)
 	}
-	s, ok := parseSchema(br, body)
+	s, ok := fs.ParseSchema(br, body)
 	body.Close()
 	if !ok {
 		return nil, fmt.Errorf("%s: previously schema; now unparseable", br)
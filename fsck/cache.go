@@ -0,0 +1,65 @@
+package fsck
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Cache is a bounded memo of recently used values. It holds two
+// generations of entries, discarding the older generation whenever
+// the newer one fills.
+type Cache struct {
+	// Size is the number of entries in each generation.
+	Size int
+
+	mu        sync.Mutex
+	c1, c2    map[string]interface{}
+	hit, miss int
+}
+
+func NewCache(size int) *Cache {
+	return &Cache{Size: size, c1: make(map[string]interface{})}
+}
+
+// Get returns the cached value for key, if any.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.c1[key]; ok {
+		c.hit++
+		return v, true
+	}
+	if v, ok := c.c2[key]; ok {
+		c.hit++
+		// promote, so that it survives the next generation
+		c.add(key, v)
+		return v, true
+	}
+	c.miss++
+	return nil, false
+}
+
+// Add caches a value for key.
+func (c *Cache) Add(key string, v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(key, v)
+}
+
+func (c *Cache) add(key string, v interface{}) {
+	if len(c.c1) >= c.Size {
+		c.c2 = c.c1
+		c.c1 = make(map[string]interface{})
+	}
+	c.c1[key] = v
+}
+
+func (c *Cache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rate := 0.0
+	if total := c.hit + c.miss; total > 0 {
+		rate = float64(100*c.hit) / float64(total)
+	}
+	return fmt.Sprintf("%d hits, %d misses (%.0f%%)", c.hit, c.miss, rate)
+}
@@ -0,0 +1,41 @@
+package fsck
+
+import "testing"
+
+func TestCache(t *testing.T) {
+	c := NewCache(2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	// fills the first generation, so a and b move to the second
+	c.Add("c", 3)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Errorf("a: %v, %v", v, ok)
+	}
+	// a was promoted alongside c, so adding d, which starts
+	// another generation, drops only b
+	c.Add("d", 4)
+	for _, want := range []struct {
+		key string
+		v   int
+	}{{"a", 1}, {"c", 3}, {"d", 4}} {
+		if v, ok := c.Get(want.key); !ok || v != want.v {
+			t.Errorf("%s: %v, %v, want %v", want.key, v, ok, want.v)
+		}
+	}
+	if v, ok := c.Get("b"); ok {
+		t.Errorf("b: %v still cached", v)
+	}
+	if got, want := c.String(), "4 hits, 1 misses (80%)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestCacheEmpty(t *testing.T) {
+	c := NewCache(1)
+	if _, ok := c.Get("a"); ok {
+		t.Error("empty cache hit")
+	}
+	if got, want := c.String(), "0 hits, 1 misses (0%)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
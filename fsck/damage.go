@@ -0,0 +1,94 @@
+package fsck
+
+import (
+	"fmt"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/schema"
+)
+
+// Range is a span of bytes within a file, from Start up to but not
+// including End.
+type Range struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// Damage walks the parts of a "file" or "bytes" schema blob, returning
+// the ranges of its contents that are held by blobs for which missing
+// returns true. Parts held by "bytes" blobs that can't be fetched or
+// parsed are considered damaged in their entirety.
+func Damage(fetcher blob.Fetcher, s *schema.Blob, missing func(blob.Ref) bool) []Range {
+	var d damage
+	d.walk(fetcher, s, missing, 0, 0, s.PartsSize())
+	return d
+}
+
+type damage []Range
+
+// add notes damage to a range, merging it with any immediately
+// preceding damage.
+func (d *damage) add(start, end int64) {
+	if n := len(*d); n > 0 && (*d)[n-1].End == start {
+		(*d)[n-1].End = end
+		return
+	}
+	*d = append(*d, Range{start, end})
+}
+
+// walk notes damage to the contents of s between from and to, which
+// appear in the file at base.
+func (d *damage) walk(fetcher blob.Fetcher, s *schema.Blob, missing func(blob.Ref) bool, base, from, to int64) {
+	var pos int64
+	for _, bp := range s.ByteParts() {
+		partStart := pos
+		pos += int64(bp.Size)
+		// the wanted portion of this part, relative to s
+		start, end := partStart, pos
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+		if start >= end {
+			continue
+		}
+		fileStart, fileEnd := base+start-from, base+end-from
+		switch {
+		case bp.BlobRef.Valid():
+			if missing(bp.BlobRef) {
+				d.add(fileStart, fileEnd)
+			}
+		case bp.BytesRef.Valid():
+			if missing(bp.BytesRef) {
+				d.add(fileStart, fileEnd)
+				continue
+			}
+			sub, ok := FetchSchema(fetcher, bp.BytesRef)
+			if !ok {
+				d.add(fileStart, fileEnd)
+				continue
+			}
+			// the same portion, relative to the referenced bytes
+			subFrom := int64(bp.Offset) + start - partStart
+			d.walk(fetcher, sub, missing, fileStart, subFrom, subFrom+end-start)
+		default:
+			// zero-filled holes are never damaged
+		}
+	}
+}
+
+// FetchSchema fetches and parses a schema blob.
+func FetchSchema(fetcher blob.Fetcher, ref blob.Ref) (*schema.Blob, bool) {
+	body, _, err := fetcher.Fetch(ref)
+	if err != nil {
+		return nil, false
+	}
+	defer body.Close()
+	return ParseSchema(ref, body)
+}
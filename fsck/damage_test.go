@@ -0,0 +1,151 @@
+package fsck
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/schema"
+)
+
+// memFetcher holds blobs in memory, keyed by ref.
+type memFetcher map[string][]byte
+
+func (m memFetcher) Fetch(r blob.Ref) (io.ReadCloser, uint32, error) {
+	data, ok := m[r.String()]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), uint32(len(data)), nil
+}
+
+// add stores a blob under the ref of its contents.
+func (m memFetcher) add(data string) blob.Ref {
+	r := blob.SHA1FromString(data)
+	m[r.String()] = []byte(data)
+	return r
+}
+
+// part is a "parts" entry of a schema blob.
+func part(key string, r blob.Ref, size, offset int) string {
+	if key == "" {
+		return fmt.Sprintf(`{"size": %d}`, size)
+	}
+	return fmt.Sprintf(`{%q: %q, "size": %d, "offset": %d}`, key, r, size, offset)
+}
+
+// addSchema stores and parses a schema blob of camliType with parts.
+func (m memFetcher) addSchema(t *testing.T, camliType string, parts ...string) (*schema.Blob, blob.Ref) {
+	r := m.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": %q, "parts": [%s]}`,
+		camliType, strings.Join(parts, ", ")))
+	s, ok := FetchSchema(m, r)
+	if !ok {
+		t.Fatalf("%s: unparseable", r)
+	}
+	return s, r
+}
+
+// testFile is a file made of chunks and a slice of a "bytes" blob:
+//
+//	0-5   aaaaa
+//	5-9   bbcc, from offset 1 of bbbcc
+//	9-12  a hole
+//	12-17 aaaaa
+type testFile struct {
+	fetcher  memFetcher
+	file     *schema.Blob
+	contents string
+	a, b, c  blob.Ref
+	bytes    blob.Ref
+}
+
+func newTestFile(t *testing.T) *testFile {
+	f := &testFile{fetcher: make(memFetcher)}
+	f.a, f.b, f.c = f.fetcher.add("aaaaa"), f.fetcher.add("bbb"), f.fetcher.add("cc")
+	_, f.bytes = f.fetcher.addSchema(t, "bytes",
+		part("blobRef", f.b, 3, 0),
+		part("blobRef", f.c, 2, 0))
+	f.file, _ = f.fetcher.addSchema(t, "file",
+		part("blobRef", f.a, 5, 0),
+		part("bytesRef", f.bytes, 4, 1),
+		part("", blob.Ref{}, 3, 0),
+		part("blobRef", f.a, 5, 0))
+	f.contents = "aaaaabbcc\x00\x00\x00aaaaa"
+	return f
+}
+
+func TestDamage(t *testing.T) {
+	f := newTestFile(t)
+	for _, test := range []struct {
+		name    string
+		missing []blob.Ref
+		// removed from the blobstore, without being missing
+		unfetchable []blob.Ref
+		want        []Range
+	}{
+		{
+			name: "intact",
+		},
+		{
+			name:    "repeated chunk",
+			missing: []blob.Ref{f.a},
+			want:    []Range{{0, 5}, {12, 17}},
+		},
+		{
+			name:    "start of a slice",
+			missing: []blob.Ref{f.b},
+			want:    []Range{{5, 7}},
+		},
+		{
+			name:    "end of a slice",
+			missing: []blob.Ref{f.c},
+			want:    []Range{{7, 9}},
+		},
+		{
+			name:    "adjacent ranges merged",
+			missing: []blob.Ref{f.a, f.b, f.c},
+			want:    []Range{{0, 9}, {12, 17}},
+		},
+		{
+			name:    "missing bytes",
+			missing: []blob.Ref{f.bytes},
+			want:    []Range{{5, 9}},
+		},
+		{
+			name:        "unfetchable bytes",
+			unfetchable: []blob.Ref{f.bytes},
+			want:        []Range{{5, 9}},
+		},
+	} {
+		fetcher := make(memFetcher)
+		for r, data := range f.fetcher {
+			fetcher[r] = data
+		}
+		for _, r := range test.unfetchable {
+			delete(fetcher, r.String())
+		}
+		missing := make(map[blob.Ref]bool)
+		for _, r := range test.missing {
+			missing[r] = true
+		}
+		got := Damage(fetcher, f.file, func(r blob.Ref) bool { return missing[r] })
+		if len(got) == 0 && len(test.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRangeString(t *testing.T) {
+	if got := (Range{131072, 196608}).String(); got != "131072-196608" {
+		t.Errorf("got %q", got)
+	}
+}
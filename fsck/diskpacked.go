@@ -0,0 +1,172 @@
+package fsck
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ParseToken splits a diskpacked stream token into the number of the
+// pack file containing a blob and the blob's offset within it.
+func ParseToken(token string) (pack int, offset int64, err error) {
+	_, err = fmt.Sscanf(token, "%d %d", &pack, &offset)
+	return
+}
+
+// Token returns the diskpacked stream token for a blob at offset in
+// pack.
+func Token(pack int, offset int64) string {
+	return fmt.Sprintf("%d %d", pack, offset)
+}
+
+// ParsePackRange parses a pack number or an inclusive range of pack
+// numbers. An empty range includes every pack.
+func ParsePackRange(r string) (lo, hi int, err error) {
+	if r == "" {
+		return 0, int(^uint(0) >> 1), nil
+	}
+	if _, err = fmt.Sscanf(r, "%d-%d", &lo, &hi); err == nil {
+		return
+	}
+	if _, err = fmt.Sscanf(r, "%d", &lo); err != nil {
+		return 0, 0, fmt.Errorf("unparseable pack range %q", r)
+	}
+	return lo, lo, nil
+}
+
+// PackName returns the file name of a diskpacked pack file.
+func PackName(pack int) string {
+	return fmt.Sprintf("pack-%05d.blobs", pack)
+}
+
+// PackFiles checks for blobs at their locations in the pack files of
+// a diskpacked blobstore, without going through its index. The most
+// recently used pack files are kept open, since blobs are looked up
+// in ref order, which jumps between packs.
+type PackFiles struct {
+	Dir string
+
+	maxOpen int
+	// open pack files, or nil for those that don't exist
+	files map[int]*os.File
+	// packs in files, least recently used first
+	used []int
+}
+
+func NewPackFiles(dir string) *PackFiles {
+	return &PackFiles{Dir: dir, maxOpen: 8, files: make(map[int]*os.File)}
+}
+
+// Has reports whether the header of the blob ref is at location, a
+// diskpacked stream token. The size recorded in the header must match
+// size, unless size is zero, as it is in indexes built before sizes
+// were recorded.
+func (p *PackFiles) Has(ref string, size uint32, location string) (bool, error) {
+	_, _, _, ok, err := p.find(ref, size, location)
+	return ok, err
+}
+
+// Read returns the contents of the blob ref at location, or false if
+// it isn't there. Its size is taken from its header, and is checked
+// as by Has. If the pack file ends within the contents, what remains
+// is returned, so that it fails to match the ref.
+func (p *PackFiles) Read(ref string, size uint32, location string) ([]byte, bool, error) {
+	f, offset, size, ok, err := p.find(ref, size, location)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	data := make([]byte, size)
+	switch n, err := f.ReadAt(data, offset); err {
+	case nil:
+		return data, true, nil
+	case io.EOF:
+		return data[:n], true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// open returns pack, opening it if it isn't already open and closing
+// the least recently used pack file if too many are. It returns nil
+// if the pack file doesn't exist.
+func (p *PackFiles) open(pack int) (*os.File, error) {
+	if f, ok := p.files[pack]; ok {
+		for i, n := range p.used {
+			if n == pack {
+				p.used = append(p.used[:i], p.used[i+1:]...)
+				p.used = append(p.used, pack)
+				break
+			}
+		}
+		return f, nil
+	}
+	f, err := os.Open(filepath.Join(p.Dir, PackName(pack)))
+	switch {
+	case os.IsNotExist(err):
+		f = nil
+	case err != nil:
+		return nil, err
+	}
+	for len(p.used) > 0 && len(p.used) >= p.maxOpen {
+		if old := p.files[p.used[0]]; old != nil {
+			old.Close()
+		}
+		delete(p.files, p.used[0])
+		p.used = p.used[1:]
+	}
+	p.files[pack] = f
+	p.used = append(p.used, pack)
+	return f, nil
+}
+
+// find checks the header of the blob at location, returning its
+// pack file, the offset of the blob's contents within it, and their
+// size, if it's there.
+func (p *PackFiles) find(ref string, want uint32, location string) (f *os.File, offset int64, size uint32, ok bool, err error) {
+	pack, offset, err := ParseToken(location)
+	if err != nil {
+		return
+	}
+	if f, err = p.open(pack); err != nil || f == nil {
+		return
+	}
+	// "[ref size]", with room for the largest size
+	prefix := []byte("[" + ref + " ")
+	header := make([]byte, len(prefix)+11)
+	n, err := f.ReadAt(header, offset)
+	switch {
+	case err == io.EOF:
+		// the header may be at the end of a truncated pack
+		err = nil
+	case err != nil:
+		return
+	}
+	header = header[:n]
+	end := bytes.IndexByte(header, ']')
+	if !bytes.HasPrefix(header, prefix) || end < 0 {
+		return nil, 0, 0, false, nil
+	}
+	n64, err := strconv.ParseUint(string(header[len(prefix):end]), 10, 32)
+	if err != nil {
+		// the blob is there, but can't be read
+		return nil, 0, 0, false, fmt.Errorf("%s: unparseable header at %q: %q", ref, location, header[:end+1])
+	}
+	size = uint32(n64)
+	if want != 0 && want != size {
+		return nil, 0, 0, false, nil
+	}
+	return f, offset + int64(end+1), size, true, nil
+}
+
+// Close closes the open pack files.
+func (p *PackFiles) Close() {
+	for _, f := range p.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	p.files, p.used = make(map[int]*os.File), nil
+}
@@ -0,0 +1,141 @@
+package fsck
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	for _, test := range []struct {
+		pack   int
+		offset int64
+	}{
+		{0, 0},
+		{3, 12345},
+		{99999, 1 << 40},
+	} {
+		token := Token(test.pack, test.offset)
+		pack, offset, err := ParseToken(token)
+		if err != nil || pack != test.pack || offset != test.offset {
+			t.Errorf("%q: %d, %d, %v, want %d, %d", token, pack, offset, err, test.pack, test.offset)
+		}
+	}
+	if _, _, err := ParseToken("sha1-foo"); err == nil {
+		t.Error("parsed a ref as a token")
+	}
+}
+
+// writePack writes pack n, holding each blob as contents of a ref,
+// and returns their tokens.
+func writePack(t *testing.T, dir string, n int, blobs ...string) []string {
+	var data []byte
+	var tokens []string
+	for i, b := range blobs {
+		tokens = append(tokens, Token(n, int64(len(data))))
+		data = append(data, fmt.Sprintf("[ref%d %d]%s", i, len(b), b)...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, PackName(n)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestPackFilesHas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := NewPackFiles(dir)
+	defer p.Close()
+	p.maxOpen = 2
+	var tokens [][]string
+	for n := 0; n < 4; n++ {
+		tokens = append(tokens, writePack(t, dir, n, "hello", "world"))
+	}
+	for _, test := range []struct {
+		ref      string
+		size     uint32
+		location string
+		want     bool
+	}{
+		{"ref0", 5, tokens[0][0], true},
+		{"ref1", 5, tokens[0][1], true},
+		{"ref1", 0, tokens[1][1], true},
+		{"ref1", 4, tokens[1][1], false},
+		{"ref0", 5, tokens[2][1], false},
+		{"ref0", 5, "2 3", false},
+		{"ref0", 5, "2 1000", false},
+		{"ref0", 5, tokens[3][0], true},
+		{"ref0", 5, Token(7, 0), false},
+		// evicted and reopened
+		{"ref1", 5, tokens[0][1], true},
+	} {
+		if got, err := p.Has(test.ref, test.size, test.location); err != nil || got != test.want {
+			t.Errorf("%s %d at %q: %v, %v, want %v", test.ref, test.size, test.location, got, err, test.want)
+		}
+		if len(p.used) > p.maxOpen {
+			t.Errorf("%d pack files open", len(p.used))
+		}
+	}
+}
+
+func TestParsePackRange(t *testing.T) {
+	for _, test := range []struct {
+		r      string
+		lo, hi int
+		ok     bool
+	}{
+		{"", 0, int(^uint(0) >> 1), true},
+		{"3", 3, 3, true},
+		{"3-7", 3, 7, true},
+		{"x", 0, 0, false},
+		{"-", 0, 0, false},
+	} {
+		lo, hi, err := ParsePackRange(test.r)
+		if (err == nil) != test.ok || lo != test.lo || hi != test.hi {
+			t.Errorf("%q: %d, %d, %v, want %d, %d", test.r, lo, hi, err, test.lo, test.hi)
+		}
+	}
+}
+
+func TestPackFilesRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokens := writePack(t, dir, 0, "hello", "world")
+	// cut short within the contents of ref1, and within its header
+	writePack(t, dir, 1, "hello", "world")
+	writePack(t, dir, 2, "hello", "world")
+	for n, size := range map[int]int64{1: 23, 2: 18} {
+		if err := os.Truncate(filepath.Join(dir, PackName(n)), size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := NewPackFiles(dir)
+	defer p.Close()
+	for _, test := range []struct {
+		ref      string
+		size     uint32
+		location string
+		want     string
+		ok       bool
+	}{
+		{"ref0", 5, tokens[0], "hello", true},
+		{"ref1", 0, tokens[1], "world", true},
+		{"ref1", 4, tokens[1], "", false},
+		{"ref0", 5, tokens[1], "", false},
+		{"ref1", 5, Token(1, 13), "wo", true},
+		{"ref1", 5, Token(2, 13), "", false},
+	} {
+		data, ok, err := p.Read(test.ref, test.size, test.location)
+		if err != nil || ok != test.ok || string(data) != test.want {
+			t.Errorf("%s %d at %q: %q, %v, %v, want %q, %v", test.ref, test.size, test.location, data, ok, err, test.want, test.ok)
+		}
+	}
+}
@@ -1,18 +1,22 @@
 package fsck
 
 import (
+	"encoding/json"
 	"io"
 	"log"
+	"path"
 
 	"camlistore.org/pkg/blob"
-	"camlistore.org/pkg/index"
 	"camlistore.org/pkg/schema"
 )
 
-// File is an opened file from the repo.
+// File is an opened file from the repo. Directories, symlinks and
+// special files have no contents to read.
 type File struct {
 	io.ReadSeeker
 	*schema.Blob
+	// Path is the file's path within the tree it was found in.
+	Path string
 }
 
 // Files provides a stream of open file readers from the repo.
@@ -46,7 +50,7 @@ func (f Files) ReadRefs(refs <-chan string) {
 			f.Missing <- ref
 			continue
 		}
-		s, ok := parseSchema(br, body)
+		s, ok := ParseSchema(br, body)
 		body.Close()
 		if !ok {
 			f.Invalid <- ref
@@ -57,19 +61,107 @@ func (f Files) ReadRefs(refs <-chan string) {
 			f.Unreadable <- ref
 			continue
 		}
-		f.Readers <- File{ReadSeeker: file, Blob: s}
+		f.Readers <- File{ReadSeeker: file, Blob: s, Path: s.FileName()}
 	}
 }
 
-func (f Files) Close() {
-	close(f.Readers)
+// Tree is a ref to a file, directory, symlink or static-set, and the
+// path at which to place it. An empty Path places it under its own
+// name, or for a static-set, places its members at the top level.
+type Tree struct {
+	Ref, Path string
+}
+
+// ReadTrees opens all files, directories, symlinks and special files
+// within the trees supplied on the provided channel. Directories are
+// sent before their contents.
+func (f Files) ReadTrees(trees <-chan Tree) {
+	for t := range trees {
+		f.readTree(t.Ref, "", t.Path)
+	}
+}
+
+// readTree opens the tree at ref, placing it at p or, if p is empty,
+// under its own name in dir.
+func (f Files) readTree(ref, dir, p string) {
+	br, ok := blob.Parse(ref)
+	if !ok {
+		f.Invalid <- ref
+		return
+	}
+	body, _, err := f.Fetcher.Fetch(br)
+	if err != nil {
+		f.Missing <- ref
+		return
+	}
+	s, ok := ParseSchema(br, body)
+	body.Close()
+	if !ok {
+		f.Invalid <- ref
+		return
+	}
+	if p == "" && s.Type() != "static-set" {
+		p = path.Join(dir, s.FileName())
+	}
+	switch s.Type() {
+	case "file":
+		file, err := s.NewFileReader(f.Fetcher)
+		if err != nil {
+			f.Unreadable <- ref
+			return
+		}
+		f.Readers <- File{ReadSeeker: file, Blob: s, Path: p}
+	case "symlink", "fifo", "socket":
+		f.Readers <- File{Blob: s, Path: p}
+	case "directory":
+		f.Readers <- File{Blob: s, Path: p}
+		entries, ok := s.DirectoryEntries()
+		if !ok {
+			f.Invalid <- ref
+			return
+		}
+		f.readTree(entries.String(), p, p)
+	case "static-set":
+		for _, m := range s.StaticSetMembers() {
+			f.readTree(m.String(), p, "")
+		}
+	default:
+		f.Unreadable <- ref
+	}
 }
 
-func parseSchema(ref blob.Ref, body io.Reader) (*schema.Blob, bool) {
-	sn := index.NewBlobSniffer(ref)
-	io.Copy(sn, body)
-	sn.Parse()
-	return sn.SchemaBlob()
+// SymlinkTarget returns the target of a "symlink" schema blob.
+func SymlinkTarget(s *schema.Blob) (string, bool) {
+	var link struct {
+		Target *string `json:"symlinkTarget"`
+		// a mix of strings and bytes, for targets that aren't UTF-8
+		TargetBytes []interface{} `json:"symlinkTargetBytes"`
+	}
+	if err := json.Unmarshal([]byte(s.JSON()), &link); err != nil {
+		return "", false
+	}
+	if link.Target != nil {
+		return *link.Target, true
+	}
+	if link.TargetBytes == nil {
+		return "", false
+	}
+	var target []byte
+	for _, part := range link.TargetBytes {
+		switch part := part.(type) {
+		case string:
+			target = append(target, part...)
+		case float64:
+			target = append(target, byte(part))
+		default:
+			return "", false
+		}
+	}
+	return string(target), true
+}
+
+func (f Files) Close() {
+	close(f.Readers)
 }
 
 // LogErrors is a utility routine for dumping all encountered errors
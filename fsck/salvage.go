@@ -0,0 +1,185 @@
+package fsck
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/schema"
+)
+
+// Salvage writes the contents of a "file" or "bytes" schema blob to w,
+// writing zeros in place of any parts that can't be fetched or whose
+// contents don't match their refs. It returns the ranges of the
+// contents that were replaced by zeros.
+func Salvage(w io.Writer, fetcher blob.Fetcher, s *schema.Blob) ([]Range, error) {
+	sv := &salvager{w: w, fetcher: fetcher}
+	size := s.PartsSize()
+	if err := sv.walk(s, 0, size); err != nil {
+		return sv.holes, err
+	}
+	if sv.pos < size {
+		// malformed parts
+		if err := sv.zeros(size-sv.pos, true); err != nil {
+			return sv.holes, err
+		}
+	}
+	return sv.holes, nil
+}
+
+type salvager struct {
+	w       io.Writer
+	fetcher blob.Fetcher
+	holes   damage
+	// bytes written so far
+	pos int64
+}
+
+var zeroBuf [32 * 1024]byte
+
+// zeros writes n zeros, noting them as a hole if they replace damaged
+// contents.
+func (sv *salvager) zeros(n int64, damaged bool) error {
+	if damaged {
+		sv.holes.add(sv.pos, sv.pos+n)
+	}
+	for n > 0 {
+		chunk := n
+		if chunk > int64(len(zeroBuf)) {
+			chunk = int64(len(zeroBuf))
+		}
+		if err := sv.write(zeroBuf[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func (sv *salvager) write(data []byte) error {
+	n, err := sv.w.Write(data)
+	sv.pos += int64(n)
+	return err
+}
+
+// walk writes the contents of s between from and to.
+func (sv *salvager) walk(s *schema.Blob, from, to int64) error {
+	var pos int64
+	for _, bp := range s.ByteParts() {
+		partStart := pos
+		pos += int64(bp.Size)
+		start, end := partStart, pos
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+		if start >= end {
+			continue
+		}
+		// offset of the wanted portion within the referenced blob
+		offset := int64(bp.Offset) + start - partStart
+		n := end - start
+		switch {
+		case bp.BlobRef.Valid():
+			data, ok := fetchVerified(sv.fetcher, bp.BlobRef)
+			if !ok || offset+n > int64(len(data)) {
+				if err := sv.zeros(n, true); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := sv.write(data[offset : offset+n]); err != nil {
+				return err
+			}
+		case bp.BytesRef.Valid():
+			sub, ok := FetchSchema(sv.fetcher, bp.BytesRef)
+			if !ok {
+				if err := sv.zeros(n, true); err != nil {
+					return err
+				}
+				continue
+			}
+			before := sv.pos
+			if err := sv.walk(sub, offset, offset+n); err != nil {
+				return err
+			}
+			if short := n - (sv.pos - before); short > 0 {
+				if err := sv.zeros(short, true); err != nil {
+					return err
+				}
+			}
+		default:
+			// holes in the schema are zeros by design
+			if err := sv.zeros(n, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchVerified returns the contents of a blob, if they can be fetched
+// and match its ref.
+func fetchVerified(fetcher blob.Fetcher, ref blob.Ref) ([]byte, bool) {
+	body, _, err := fetcher.Fetch(ref)
+	if err != nil {
+		return nil, false
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, false
+	}
+	h := ref.Hash()
+	h.Write(data)
+	return data, ref.HashMatches(h)
+}
+
+// Verify checks that the contents read from r match the contents of a
+// "file" or "bytes" schema blob. Ranges that can't be checked because
+// they're damaged in the blobstore are returned, and don't match.
+func Verify(r io.Reader, fetcher blob.Fetcher, s *schema.Blob) (ok bool, holes []Range, err error) {
+	cw := &compareWriter{r: r}
+	if holes, err = Salvage(cw, fetcher, s); err != nil {
+		return
+	}
+	if cw.err != nil {
+		return false, holes, cw.err
+	}
+	// r should hold nothing more
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		cw.mismatch = true
+	}
+	return !cw.mismatch && len(holes) == 0, holes, nil
+}
+
+// compareWriter notes whether everything written to it matches what
+// is read from r.
+type compareWriter struct {
+	r        io.Reader
+	buf      []byte
+	mismatch bool
+	err      error
+}
+
+func (cw *compareWriter) Write(p []byte) (int, error) {
+	if cw.mismatch || cw.err != nil {
+		return len(p), nil
+	}
+	if cap(cw.buf) < len(p) {
+		cw.buf = make([]byte, len(p))
+	}
+	buf := cw.buf[:len(p)]
+	switch _, err := io.ReadFull(cw.r, buf); err {
+	case nil:
+		cw.mismatch = !bytes.Equal(buf, p)
+	case io.EOF, io.ErrUnexpectedEOF:
+		cw.mismatch = true
+	default:
+		cw.err = err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,91 @@
+package fsck
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blob"
+)
+
+func TestSalvage(t *testing.T) {
+	f := newTestFile(t)
+	for _, test := range []struct {
+		name string
+		// removed from the blobstore
+		gone []blob.Ref
+		// stored with the wrong contents
+		corrupt  []blob.Ref
+		want     string
+		wantHole []Range
+	}{
+		{
+			name: "intact",
+			want: f.contents,
+		},
+		{
+			name:     "missing chunk",
+			gone:     []blob.Ref{f.c},
+			want:     "aaaaabb\x00\x00\x00\x00\x00aaaaa",
+			wantHole: []Range{{7, 9}},
+		},
+		{
+			name:     "corrupt chunk",
+			corrupt:  []blob.Ref{f.a},
+			want:     "\x00\x00\x00\x00\x00bbcc\x00\x00\x00\x00\x00\x00\x00\x00",
+			wantHole: []Range{{0, 5}, {12, 17}},
+		},
+		{
+			name:     "missing bytes",
+			gone:     []blob.Ref{f.bytes},
+			want:     "aaaaa\x00\x00\x00\x00\x00\x00\x00aaaaa",
+			wantHole: []Range{{5, 9}},
+		},
+	} {
+		fetcher := make(memFetcher)
+		for r, data := range f.fetcher {
+			fetcher[r] = data
+		}
+		for _, r := range test.gone {
+			delete(fetcher, r.String())
+		}
+		for _, r := range test.corrupt {
+			fetcher[r.String()] = bytes.ToUpper(fetcher[r.String()])
+		}
+		var out bytes.Buffer
+		holes, err := Salvage(&out, fetcher, f.file)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s: wrote %q, want %q", test.name, out.String(), test.want)
+		}
+		if len(holes) != 0 || len(test.wantHole) != 0 {
+			if !reflect.DeepEqual(holes, test.wantHole) {
+				t.Errorf("%s: holes %v, want %v", test.name, holes, test.wantHole)
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f := newTestFile(t)
+	for _, test := range []struct {
+		contents string
+		want     bool
+	}{
+		{f.contents, true},
+		{f.contents[:len(f.contents)-1], false},
+		{f.contents + "!", false},
+		{strings.Replace(f.contents, "bbcc", "bbcd", 1), false},
+	} {
+		ok, holes, err := Verify(strings.NewReader(test.contents), f.fetcher, f.file)
+		if err != nil || len(holes) > 0 {
+			t.Fatalf("%q: %v, %v", test.contents, holes, err)
+		}
+		if ok != test.want {
+			t.Errorf("%q: %v, want %v", test.contents, ok, test.want)
+		}
+	}
+}
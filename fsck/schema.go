@@ -0,0 +1,69 @@
+package fsck
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/schema"
+)
+
+// ParseSchema parses a blob as a schema blob, if it is one.
+func ParseSchema(ref blob.Ref, body io.Reader) (*schema.Blob, bool) {
+	sn := index.NewBlobSniffer(ref)
+	io.Copy(sn, body)
+	sn.Parse()
+	return sn.SchemaBlob()
+}
+
+// Dependencies returns the refs that a schema blob needs in order to
+// be complete.
+func Dependencies(s *schema.Blob) (needs []string) {
+	camliType := s.Type()
+	switch camliType {
+	case "static-set":
+		for _, r := range s.StaticSetMembers() {
+			needs = append(needs, r.String())
+		}
+	case "bytes":
+		fallthrough
+	case "file":
+		for i, bp := range s.ByteParts() {
+			ok := false
+			if r := bp.BlobRef; r.Valid() {
+				needs = append(needs, r.String())
+				ok = true
+			}
+			if r := bp.BytesRef; r.Valid() {
+				needs = append(needs, r.String())
+				ok = true
+			}
+			if !ok {
+				log.Printf("%s (%s): no valid ref in part %d", s.BlobRef(), camliType, i)
+			}
+		}
+	case "directory":
+		switch r, ok := s.DirectoryEntries(); {
+		case !ok:
+			log.Printf("%s (%s): bad entries", s.BlobRef(), camliType)
+		case !r.Valid():
+			log.Printf("%s (%s): invalid entries", s.BlobRef(), camliType)
+		default:
+			needs = append(needs, r.String())
+		}
+	}
+	return
+}
+
+// Signer returns the camliSigner of a signed schema blob.
+func Signer(s *schema.Blob) (blob.Ref, bool) {
+	var signed struct {
+		CamliSigner string `json:"camliSigner"`
+	}
+	if err := json.Unmarshal([]byte(s.JSON()), &signed); err != nil {
+		return blob.Ref{}, false
+	}
+	return blob.Parse(signed.CamliSigner)
+}
@@ -0,0 +1,28 @@
+package fsck
+
+import "time"
+
+// Throttle limits the average rate of some activity, such as reading
+// from a disk that's in use.
+type Throttle struct {
+	// Rate is the maximum rate per second; zero is unlimited.
+	Rate  float64
+	start time.Time
+	n     float64
+}
+
+// Wait notes that n more units have been consumed, and sleeps until
+// that is within the rate.
+func (t *Throttle) Wait(n int) {
+	if t.Rate <= 0 {
+		return
+	}
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	t.n += float64(n)
+	due := t.start.Add(time.Duration(t.n / t.Rate * float64(time.Second)))
+	if d := due.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
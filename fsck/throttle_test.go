@@ -0,0 +1,29 @@
+package fsck
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	for _, test := range []struct {
+		rate float64
+		n    []int
+		min  time.Duration
+		max  time.Duration
+	}{
+		{0, []int{1 << 30, 1 << 30}, 0, 50 * time.Millisecond},
+		{-1, []int{1 << 30}, 0, 50 * time.Millisecond},
+		// 50ms each
+		{10000, []int{500, 500}, 100 * time.Millisecond, time.Second},
+	} {
+		throttle := &Throttle{Rate: test.rate}
+		start := time.Now()
+		for _, n := range test.n {
+			throttle.Wait(n)
+		}
+		if d := time.Since(start); d < test.min || d > test.max {
+			t.Errorf("rate %v, waits %v: took %v, want %v-%v", test.rate, test.n, d, test.min, test.max)
+		}
+	}
+}